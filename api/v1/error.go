@@ -3,6 +3,7 @@ package log_v1
 import (
 	"fmt"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -33,3 +34,280 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrCorruptRecord is returned when the record stored at an offset fails its
+// integrity checks, so that clients can tell data loss apart from reading past
+// the end of the log.
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record at offset: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record stored at offset %d is corrupt and can't be read",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicNotFound is returned for requests to a topic that doesn't exist.
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"The topic %q doesn't exist",
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicExists is returned when creating a topic that already exists.
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic already exists: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"The topic %q already exists",
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTopic is returned for a topic name that can't be used, either
+// because it has characters other than letters, digits, '.', '_' and '-' or
+// because it's too long.
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic name: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"The topic name %q is invalid: names are made of letters, digits, '.', '_' and '-'",
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionNotFound is returned for a partition number that's not smaller
+// than the number of partitions the cluster splits topics into.
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %d", e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"The topic %q has no partition %d",
+		e.Topic,
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownMember is returned for a consumer group member that isn't in the
+// group, usually because it missed its session timeout. It has to join again.
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown member: %q", e.MemberID),
+	)
+	msg := fmt.Sprintf(
+		"The member %q isn't in the group %q: join the group again",
+		e.MemberID,
+		e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNoLeader is returned for writes to a partition whose Raft group hasn't
+// elected a leader, such as during an election. They can be retried.
+type ErrNoLeader struct {
+	Partition uint32
+}
+
+func (e ErrNoLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("no leader for partition: %d", e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"Partition %d has no leader to write to: try again shortly",
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNoLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned for writes, and reads that have to be served by a
+// partition's leader, from a server that isn't, or is no longer, its leader.
+// They can be retried on the leader.
+type ErrNotLeader struct {
+	Partition uint32
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.Unavailable,
+		fmt.Sprintf("not the leader of partition: %d", e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"This server isn't the leader of partition %d: try its leader",
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrServerNotFound is returned for a server that isn't in a partition's Raft
+// group.
+type ErrServerNotFound struct {
+	Partition uint32
+	ID        string
+}
+
+func (e ErrServerNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("server not found: %q", e.ID),
+	)
+	msg := fmt.Sprintf(
+		"The server %q isn't in partition %d's group",
+		e.ID,
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrServerNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
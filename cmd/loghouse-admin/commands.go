@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/log"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+/*
+selection is the logs the -partition, -topic and -raft flags of a command pick
+out of the data directory. Without -topic or -raft, both the topics' logs and
+the Raft logs are picked.
+*/
+type selection struct {
+	partition int
+	topic     *string
+	raft      bool
+}
+
+func selectionFlags(fs *flag.FlagSet) *selection {
+	s := &selection{}
+	fs.IntVar(&s.partition, "partition", -1, "Partition to look at, every partition when negative.")
+	fs.Func("topic", "Topic to look at, every topic when not given; empty for the default topic.",
+		func(value string) error {
+			s.topic = &value
+			return nil
+		})
+	fs.BoolVar(&s.raft, "raft", false, "Only look at the Raft logs.")
+	return s
+}
+
+// logs returns the selected logs in the data directory.
+func (c *cli) logs(s *selection) ([]log.LogDir, error) {
+	dirs, err := log.LogDirs(c.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var selected []log.LogDir
+	for _, d := range dirs {
+		if s.partition >= 0 && d.Partition != uint32(s.partition) {
+			continue
+		}
+		if s.topic != nil && (d.Raft || d.Topic != *s.topic) {
+			continue
+		}
+		if s.raft && !d.Raft {
+			continue
+		}
+		selected = append(selected, d)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no logs in %s match", c.dataDir)
+	}
+	return selected, nil
+}
+
+// logHeader says which log a line of JSON output is about.
+type logHeader struct {
+	Partition uint32 `json:"partition"`
+	Topic     string `json:"topic"`
+	Raft      bool   `json:"raft,omitempty"`
+}
+
+func newLogHeader(d log.LogDir) logHeader {
+	return logHeader{Partition: d.Partition, Topic: d.Topic, Raft: d.Raft}
+}
+
+// segments prints the segments of the selected logs.
+func (c *cli) segments(args []string) error {
+	fs := flag.NewFlagSet("segments", flag.ContinueOnError)
+	s := selectionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	dirs, err := c.logs(s)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	if c.format == textFormat {
+		fmt.Fprintln(w, "PARTITION\tTOPIC\tBASE\tNEXT\tRECORDS\tSTORE BYTES\tINDEX BYTES\tVERSION")
+	}
+	for _, d := range dirs {
+		infos, err := log.InspectLog(d.Dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if c.format == jsonFormat {
+				err = c.format.object(c.stdout, struct {
+					logHeader
+					log.SegmentInfo
+				}{newLogHeader(d), info})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", d.Partition, topicLabel(d),
+				info.BaseOffset, info.NextOffset, info.Records, info.StoreBytes,
+				info.IndexBytes, info.StoreVersion)
+		}
+	}
+	return w.Flush()
+}
+
+// dump prints the records of a log, from -offset onwards, as JSON.
+func (c *cli) dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	partition := fs.Uint("partition", 0, "Partition to dump.")
+	topic := fs.String("topic", "", "Topic to dump, the default topic when empty.")
+	raft := fs.Bool("raft", false, "Dump the partition's Raft log instead of a topic's.")
+	offset := fs.Uint64("offset", 0, "Offset to start from.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	s := &selection{partition: int(*partition), topic: topic, raft: *raft}
+	if *raft {
+		s.topic = nil
+	}
+	dirs, err := c.logs(s)
+	if err != nil {
+		return err
+	}
+	return log.DumpLog(dirs[0].Dir, *offset, func(record *api.Record) error {
+		return c.format.message(c.stdout, record)
+	})
+}
+
+/*
+verify checks the segments of the selected logs and prints the issues it finds.
+It fails if any of them means records may have been lost; offset gaps, which
+compaction leaves, and indexes that weren't closed cleanly are only printed.
+*/
+func (c *cli) verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	s := selectionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	dirs, err := c.logs(s)
+	if err != nil {
+		return err
+	}
+	corrupt := 0
+	for _, d := range dirs {
+		issues, err := log.VerifyLog(d.Dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Dir, err)
+		}
+		for _, issue := range issues {
+			if issue.Corrupt() {
+				corrupt++
+			}
+			if c.format == jsonFormat {
+				err = c.format.object(c.stdout, struct {
+					logHeader
+					log.Issue
+				}{newLogHeader(d), issue})
+			} else {
+				_, err = fmt.Fprintf(c.stdout, "partition %d, topic %s, %s\n",
+					d.Partition, topicLabel(d), issue)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if corrupt > 0 {
+		return fmt.Errorf("found %d issues that may have lost records in %s",
+			corrupt, filepath.Clean(c.dataDir))
+	}
+	return nil
+}
+
+/*
+repair rebuilds the indexes of the selected logs' segments that fail
+verification, or of every segment with -rebuild, and prints what it changed. It
+refuses to run while a server is using the data directory, and only cuts intact
+records off the end of a store whose frame lengths are corrupt with -truncate.
+*/
+func (c *cli) repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	s := selectionFlags(fs)
+	rebuild := fs.Bool("rebuild", false,
+		"Rebuild every segment's indexes, not only those of segments that fail verification.")
+	truncate := fs.Bool("truncate", false,
+		"Truncate stores at a corrupt frame length even if intact records follow it.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if err := log.CheckStopped(c.dataDir); err != nil {
+		return err
+	}
+	dirs, err := c.logs(s)
+	if err != nil {
+		return err
+	}
+	repairLog := log.RepairLog
+	if *rebuild {
+		repairLog = log.RebuildLog
+	}
+	for _, d := range dirs {
+		repairs, err := repairLog(d.Dir, log.Config{}, *truncate)
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Dir, err)
+		}
+		for _, repair := range repairs {
+			if c.format == jsonFormat {
+				err = c.format.object(c.stdout, struct {
+					logHeader
+					log.SegmentRepair
+				}{newLogHeader(d), repair})
+			} else {
+				_, err = fmt.Fprintf(c.stdout,
+					"partition %d, topic %s, segment %d: indexed %d records, "+
+						"dropped %d corrupt records, truncated %d bytes\n",
+					d.Partition, topicLabel(d), repair.BaseOffset, repair.Records,
+					repair.DroppedRecords, repair.TruncatedBytes)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// topicLabel is how a log's topic is named in text output.
+func topicLabel(d log.LogDir) string {
+	switch {
+	case d.Raft:
+		return "(raft)"
+	case d.Topic == log.DefaultTopic:
+		return "(default)"
+	}
+	return d.Topic
+}
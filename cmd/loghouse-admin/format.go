@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+)
+
+/*
+format is how segments and issues are printed:
+
+	text  a table of segments, and issues one per line
+	json  one JSON object per line
+
+Records are always dumped as JSON.
+*/
+type format string
+
+const (
+	textFormat format = "text"
+	jsonFormat format = "json"
+)
+
+func (f *format) String() string {
+	if f == nil || *f == "" {
+		return string(textFormat)
+	}
+	return string(*f)
+}
+
+func (f *format) Set(value string) error {
+	switch format(value) {
+	case textFormat, jsonFormat:
+		*f = format(value)
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", value)
+}
+
+// object prints v as one line of JSON.
+func (f format) object(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// message prints m as one line of JSON, with fields named as in the proto
+// file. protojson varies its whitespace on purpose, so the output is compacted
+// to keep it stable for scripts.
+func (f format) message(w io.Writer, m proto.Message) error {
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err = json.Compact(&out, b); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(w)
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+loghouse-admin inspects and repairs the data directory of a stopped Loghouse
+server.
+
+	loghouse-admin [flags] <command> [command flags]
+
+The commands are:
+
+	segments  list the segments of each log with their offsets and sizes
+	dump      print the records of a log as JSON, one per line
+	verify    check that every index entry points at an intact record
+	repair    rebuild indexes from the records in the stores
+
+Only repair changes the files it reads, and it refuses to while the server is
+running. The others report segments that weren't closed cleanly as they are
+rather than recovering them. The data directory is given with -data-dir, or
+LOGHOUSE_DATA_DIR like the server's.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// cli runs the commands against the logs in dataDir, writing their output to
+// stdout in the format.
+type cli struct {
+	dataDir string
+	stdout  io.Writer
+	format  format
+}
+
+var commands = map[string]struct {
+	run   func(c *cli, args []string) error
+	usage string
+}{
+	"segments": {(*cli).segments, "list the segments of each log with their offsets and sizes"},
+	"dump":     {(*cli).dump, "print the records of a log as JSON, one per line"},
+	"verify":   {(*cli).verify, "check that every index entry points at an intact record"},
+	"repair":   {(*cli).repair, "rebuild indexes from the records in the stores"},
+}
+
+func main() {
+	err := run(os.Args[1:], os.Getenv, os.Stdout)
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "loghouse-admin:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, getenv func(string) string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("loghouse-admin", flag.ContinueOnError)
+	c := &cli{stdout: stdout, format: textFormat}
+	fs.StringVar(&c.dataDir, "data-dir", getenv("LOGHOUSE_DATA_DIR"),
+		"Directory the server stores its log and Raft data in.")
+	fs.Var(&c.format, "format", "Output format of segments, verify and repair: text or json.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: loghouse-admin [flags] <command> [command flags]\n\n")
+		fmt.Fprintf(fs.Output(), "Commands:\n")
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(fs.Output(), "  %-10s%s\n", name, commands[name].usage)
+		}
+		fmt.Fprintf(fs.Output(), "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	if c.dataDir == "" {
+		return fmt.Errorf("no data directory given")
+	}
+	if _, err := os.Stat(c.dataDir); err != nil {
+		return err
+	}
+	return command.run(c, fs.Args()[1:])
+}
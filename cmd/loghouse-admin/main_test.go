@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/log"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	dataDir := t.TempDir()
+	c := log.Config{Partitions: 2}
+	c.Segment.MaxIndexBytes = 24
+	ps, err := log.NewPartitions(dataDir, c)
+	require.NoError(t, err)
+	require.NoError(t, ps.CreateTopic("events"))
+	for _, value := range []string{"first", "second", "third"} {
+		_, err = ps.Append(log.DefaultTopic, 0, &api.Record{Value: []byte(value), Timestamp: 1})
+		require.NoError(t, err)
+	}
+	_, err = ps.Append("events", 1, &api.Record{Value: []byte("event"), Timestamp: 1})
+	require.NoError(t, err)
+	require.NoError(t, ps.Close())
+	admin := func(args ...string) (string, error) {
+		var stdout bytes.Buffer
+		err := run(args, func(key string) string {
+			return map[string]string{"LOGHOUSE_DATA_DIR": dataDir}[key]
+		}, &stdout)
+		return stdout.String(), err
+	}
+
+	out, err := admin("segments", "-partition", "0", "-topic", "")
+	require.NoError(t, err)
+	require.Equal(t, `PARTITION  TOPIC      BASE  NEXT  RECORDS  STORE BYTES  INDEX BYTES  VERSION
+0          (default)  0     2     2        55           24           2
+0          (default)  2     3     1        32           12           2
+`, out)
+	out, err = admin("-format", "json", "segments", "-topic", "events")
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"topic":"events","base_offset":0,"next_offset":0,"records":0,"store_bytes":8,"index_bytes":0,"store_version":2}
+{"partition":1,"topic":"events","base_offset":0,"next_offset":1,"records":1,"store_bytes":30,"index_bytes":12,"store_version":2}
+`, out)
+
+	out, err = admin("dump", "-offset", "1")
+	require.NoError(t, err)
+	require.Equal(t, `{"value":"c2Vjb25k","offset":"1","timestamp":"1"}
+{"value":"dGhpcmQ=","offset":"2","timestamp":"1"}
+`, out)
+	_, err = admin("dump", "-topic", "missing")
+	require.Error(t, err)
+
+	out, err = admin("verify")
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	// garbage after the last record is reported and fails the check
+	store := filepath.Join(dataDir, "log", "2.store")
+	f, err := os.OpenFile(store, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("garbage"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	out, err = admin("verify")
+	require.Error(t, err)
+	require.Equal(t, "partition 0, topic (default), segment 2, offset 3: trailing_bytes: "+
+		"7 bytes at position 32, holding 0 whole unindexed records\n", out)
+
+	// and repair cuts it off
+	out, err = admin("repair")
+	require.NoError(t, err)
+	require.Equal(t, "partition 0, topic (default), segment 2: indexed 1 records, "+
+		"dropped 0 corrupt records, truncated 7 bytes\n", out)
+	out, err = admin("verify")
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+	// rebuilding every index loses nothing
+	require.NoError(t, os.Remove(filepath.Join(dataDir, "log", "0.index")))
+	out, err = admin("-format", "json", "repair", "-rebuild", "-partition", "0", "-topic", "")
+	require.NoError(t, err)
+	require.Equal(t, `{"partition":0,"topic":"","base_offset":0,"records":2,"dropped_records":0,"truncated_bytes":0}
+{"partition":0,"topic":"","base_offset":2,"records":1,"dropped_records":0,"truncated_bytes":0}
+`, out)
+	out, err = admin("dump")
+	require.NoError(t, err)
+	require.Equal(t, 3, strings.Count(out, "\n"))
+
+	err = run([]string{"verify"}, func(string) string { return "" }, &bytes.Buffer{})
+	require.Error(t, err)
+	_, err = admin("unknown")
+	require.Error(t, err)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/anshulsood11/loghouse/internal/agent"
+	"github.com/anshulsood11/loghouse/internal/config"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// envPrefix starts the names of the environment variables that set the
+// options: -data-dir is set by LOGHOUSE_DATA_DIR, and so on.
+const envPrefix = "LOGHOUSE_"
+
+// options are what the server is run with, before the TLS files are loaded.
+type options struct {
+	configFile string
+	agent      agent.Config
+	partitions uint
+	serverTLS  config.TLSConfig
+	peerTLS    config.TLSConfig
+}
+
+/*
+loadOptions reads the options from the command line arguments, the environment
+and the config file, in that order of precedence, falling back to the flags'
+defaults for options none of them set. The config file is a YAML map of flag
+names to values, and is itself named by -config-file or LOGHOUSE_CONFIG_FILE.
+*/
+func loadOptions(args []string, getenv func(string) string) (*options, error) {
+	o := &options{}
+	fs := o.flagSet()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value := getenv(env)
+		if err != nil || set[f.Name] || value == "" {
+			return
+		}
+		if err = fs.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, env, err)
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if o.configFile == "" {
+		return o, nil
+	}
+	file, err := readConfigFile(o.configFile)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range file {
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %q in %s", name, o.configFile)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s in %s: %w",
+				value, name, o.configFile, err)
+		}
+	}
+	return o, nil
+}
+
+func (o *options) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("loghouse", flag.ContinueOnError)
+	hostname, _ := os.Hostname()
+	fs.StringVar(&o.configFile, "config-file", "", "Path to a YAML config file.")
+	fs.StringVar(&o.agent.DataDir, "data-dir",
+		filepath.Join(os.TempDir(), "loghouse"), "Directory to store log and Raft data in.")
+	fs.StringVar(&o.agent.NodeName, "node-name", hostname, "Unique server ID.")
+	fs.StringVar(&o.agent.BindAddr, "bind-addr", "127.0.0.1:8401",
+		"Address to bind Serf on.")
+	fs.IntVar(&o.agent.RPCPort, "rpc-port", 8400,
+		"Port for RPC clients (and Raft) connections.")
+	fs.Var((*listValue)(&o.agent.StartJoinAddrs), "start-join-addrs",
+		"Comma-separated Serf addresses to join.")
+	fs.BoolVar(&o.agent.Bootstrap, "bootstrap", false, "Bootstrap the cluster.")
+	fs.UintVar(&o.partitions, "partitions", 1,
+		"Number of partitions topics are split into, the same on every server.")
+	fs.BoolVar(&o.agent.Nonvoter, "nonvoter", false,
+		"Run the server as a read replica that doesn't vote.")
+	fs.DurationVar(&o.agent.DrainTimeout, "drain-timeout", 10*time.Second,
+		"How long shutting down waits for in-flight requests.")
+	fs.DurationVar(&o.agent.FailedRemoveTimeout, "failed-remove-timeout", 30*time.Second,
+		"How long failed servers stay in the Raft groups, or forever when negative.")
+	fs.StringVar(&o.agent.ACLModelFile, "acl-model-file", "",
+		"Path to ACL model. Without an ACL, every request is allowed.")
+	fs.StringVar(&o.agent.ACLPolicyFile, "acl-policy-file", "",
+		"Path to ACL policy. Without an ACL, every request is allowed.")
+	fs.StringVar(&o.serverTLS.CertFile, "server-tls-cert-file", "", "Path to server tls cert.")
+	fs.StringVar(&o.serverTLS.KeyFile, "server-tls-key-file", "", "Path to server tls key.")
+	fs.StringVar(&o.serverTLS.CAFile, "server-tls-ca-file", "",
+		"Path to server certificate authority.")
+	fs.StringVar(&o.peerTLS.CertFile, "peer-tls-cert-file", "", "Path to peer tls cert.")
+	fs.StringVar(&o.peerTLS.KeyFile, "peer-tls-key-file", "", "Path to peer tls key.")
+	fs.StringVar(&o.peerTLS.CAFile, "peer-tls-ca-file", "",
+		"Path to peer certificate authority.")
+	return fs
+}
+
+/*
+agentConfig returns the agent's config with the TLS files loaded. Connections
+are only encrypted when the certificate files are given, and requests are only
+authorized when the ACL files are, which have to be given together. The peer TLS config
+leaves the server name unset, so that each connection to another server
+verifies its certificate against the host it dials.
+*/
+func (o *options) agentConfig() (agent.Config, error) {
+	c := o.agent
+	c.Partitions = uint32(o.partitions)
+	if (c.ACLModelFile == "") != (c.ACLPolicyFile == "") {
+		return c, fmt.Errorf("-acl-model-file and -acl-policy-file must be given together")
+	}
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return c, err
+	}
+	if c.ServerTLSConfig, err = loadTLS(o.serverTLS, host, true); err != nil {
+		return c, err
+	}
+	if c.PeerTLSConfig, err = loadTLS(o.peerTLS, "", false); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func loadTLS(c config.TLSConfig, host string, server bool) (*tls.Config, error) {
+	if c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	c.ServerAddress = host
+	c.Server = server
+	return config.SetupTLSConfig(c)
+}
+
+// readConfigFile reads the options in the config file as the strings their
+// flags would be set to. Lists are joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]interface{}
+	if err = yaml.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	values := make(map[string]string)
+	for name, value := range file {
+		if list, ok := value.([]interface{}); ok {
+			var items []string
+			for _, item := range list {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		} else {
+			values[name] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// listValue is a flag.Value of comma-separated strings.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/anshulsood11/loghouse/internal/test_util"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadOptions(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "loghouse.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+data-dir: /var/lib/loghouse
+node-name: from-file
+rpc-port: 9400
+start-join-addrs:
+  - 10.0.0.1:8401
+  - 10.0.0.2:8401
+bootstrap: true
+partitions: 3
+drain-timeout: 1m
+server-tls-cert-file: `+test_util.ServerCertFile+`
+server-tls-key-file: `+test_util.ServerKeyFile+`
+server-tls-ca-file: `+test_util.CAFile+`
+`), 0644))
+	env := map[string]string{
+		"LOGHOUSE_CONFIG_FILE": configFile,
+		"LOGHOUSE_NODE_NAME":   "from-env",
+		"LOGHOUSE_RPC_PORT":    "9500",
+	}
+
+	// flags win over the environment, which wins over the config file
+	options, err := loadOptions([]string{"-node-name", "from-flag"}, func(key string) string {
+		return env[key]
+	})
+	require.NoError(t, err)
+	config, err := options.agentConfig()
+	require.NoError(t, err)
+	require.Equal(t, "from-flag", config.NodeName)
+	require.Equal(t, 9500, config.RPCPort)
+	require.Equal(t, "/var/lib/loghouse", config.DataDir)
+	require.Equal(t, []string{"10.0.0.1:8401", "10.0.0.2:8401"}, config.StartJoinAddrs)
+	require.True(t, config.Bootstrap)
+	require.Equal(t, uint32(3), config.Partitions)
+	require.Equal(t, time.Minute, config.DrainTimeout)
+	// and the flags' defaults fill in the rest
+	require.Equal(t, "127.0.0.1:8401", config.BindAddr)
+	require.Equal(t, 30*time.Second, config.FailedRemoveTimeout)
+	require.False(t, config.Nonvoter)
+
+	// TLS is set up for the connections whose files are given
+	require.NotNil(t, config.ServerTLSConfig)
+	require.Equal(t, 1, len(config.ServerTLSConfig.Certificates))
+	require.Equal(t, "127.0.0.1", config.ServerTLSConfig.ServerName)
+	require.Nil(t, config.PeerTLSConfig)
+
+	// peer connections are verified against the server they dial
+	options, err = loadOptions([]string{
+		"-peer-tls-cert-file", test_util.RootClientCertFile,
+		"-peer-tls-key-file", test_util.RootClientKeyFile,
+		"-peer-tls-ca-file", test_util.CAFile,
+	}, func(string) string { return "" })
+	require.NoError(t, err)
+	config, err = options.agentConfig()
+	require.NoError(t, err)
+	require.NotNil(t, config.PeerTLSConfig)
+	require.Empty(t, config.PeerTLSConfig.ServerName)
+
+	require.NoError(t, os.WriteFile(configFile, []byte("bootstrapp: true\n"), 0644))
+	_, err = loadOptions(nil, func(key string) string { return env[key] })
+	require.Error(t, err)
+	_, err = loadOptions([]string{"-rpc-port", "port"}, func(string) string { return "" })
+	require.Error(t, err)
+	_, err = loadOptions(nil, func(key string) string {
+		return map[string]string{"LOGHOUSE_BOOTSTRAP": "maybe"}[key]
+	})
+	require.Error(t, err)
+}
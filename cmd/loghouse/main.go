@@ -0,0 +1,44 @@
+/*
+loghouse runs a Loghouse server. It's configured with flags, LOGHOUSE_*
+environment variables and a YAML config file, and drains and shuts down on
+SIGINT or SIGTERM.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/anshulsood11/loghouse/internal/agent"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "loghouse:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	options, err := loadOptions(args, os.Getenv)
+	if err != nil {
+		return err
+	}
+	config, err := options.agentConfig()
+	if err != nil {
+		return err
+	}
+	a, err := agent.NewAgent(config)
+	if err != nil {
+		return err
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
+	return a.Shutdown()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/agent"
+	"github.com/anshulsood11/loghouse/internal/test_util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"testing"
+)
+
+func TestDefaultConfigServes(t *testing.T) {
+	// only what it takes to run a server on this machine, without TLS or an ACL
+	ports := test_util.GetFreePorts(2)
+	options, err := loadOptions([]string{
+		"-data-dir", t.TempDir(),
+		"-bootstrap",
+		"-bind-addr", fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		"-rpc-port", fmt.Sprint(ports[1]),
+	}, func(string) string { return "" })
+	require.NoError(t, err)
+	config, err := options.agentConfig()
+	require.NoError(t, err)
+	a, err := agent.NewAgent(config)
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	rpcAddr, err := config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	produce, err := api.NewLogClient(conn).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	// but an ACL needs both its files
+	options, err = loadOptions([]string{"-acl-model-file", test_util.ACLModelFile},
+		func(string) string { return "" })
+	require.NoError(t, err)
+	_, err = options.agentConfig()
+	require.Error(t, err)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// produceBatchSize is how many lines produce appends in one request.
+	produceBatchSize = 500
+	// maxLineSize is the longest line produce reads as a record, which is kept
+	// under gRPC's default 4MB message size limit.
+	maxLineSize = 3 << 20
+)
+
+/*
+produce appends its arguments to the log as records, or the lines of the files
+it's given, or of stdin when there are neither, and prints each record's offset.
+*/
+func (c *cli) produce(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: loghousectl produce [flags] [value ...]\n\n")
+		fs.PrintDefaults()
+	}
+	topic := fs.String("topic", "", "Topic to produce to, the default topic when empty.")
+	partition := fs.Uint("partition", 0, "Partition to produce to.")
+	key := fs.String("key", "", "Key to give the records.")
+	var files listValue
+	fs.Var(&files, "file", "File to read records from, one per line; can be repeated.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 && len(files) > 0 {
+		return fmt.Errorf("produce takes values or files, not both")
+	}
+	var batch []*api.Record
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := c.client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+			Records:   batch,
+			Topic:     *topic,
+			Partition: uint32(*partition),
+		})
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			if err = c.format.offset(c.stdout, res.FirstOffset+uint64(i)); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	add := func(value []byte) error {
+		batch = append(batch, &api.Record{Key: []byte(*key), Value: value})
+		if len(batch) < produceBatchSize {
+			return nil
+		}
+		return flush()
+	}
+	readLines := func(r io.Reader) error {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, maxLineSize)
+		for scanner.Scan() {
+			if err := add(append([]byte(nil), scanner.Bytes()...)); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	switch {
+	case fs.NArg() > 0:
+		for _, value := range fs.Args() {
+			if err := add([]byte(value)); err != nil {
+				return err
+			}
+		}
+	case len(files) > 0:
+		for _, name := range files {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			err = readLines(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		if err := readLines(c.stdin); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+/*
+consume prints the record at -offset, the records from -offset up to -end, or,
+with -f, the records from -offset onwards as they're appended until it's
+interrupted.
+*/
+func (c *cli) consume(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: loghousectl consume [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	topic := fs.String("topic", "", "Topic to consume, the default topic when empty.")
+	partition := fs.Uint("partition", 0, "Partition to consume.")
+	offset := fs.Uint64("offset", 0, "Offset to start from.")
+	end := fs.Uint64("end", 0, "Offset to stop before, reading a range of records.")
+	follow := fs.Bool("f", false, "Follow the partition, printing records as they're appended.")
+	group := fs.String("group", "",
+		"Consumer group whose committed offset -f starts from, when it has one.")
+	consistency := fs.String("consistency", "local",
+		"How up to date the log is: local, leader_verified or at_least.")
+	minOffset := fs.Uint64("min-offset", 0, "Offset an at_least read waits for.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	level, ok := api.Consistency_value[strings.ToUpper(*consistency)]
+	if !ok {
+		return fmt.Errorf("unknown consistency %q", *consistency)
+	}
+	req := &api.ConsumeRequest{
+		Offset:      *offset,
+		Topic:       *topic,
+		Partition:   uint32(*partition),
+		Group:       *group,
+		Consistency: api.Consistency(level),
+		MinOffset:   *minOffset,
+	}
+
+	switch {
+	case *follow:
+		stream, err := c.client.ConsumeStream(ctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				if status.Code(err) == codes.Canceled {
+					// interrupted
+					return nil
+				}
+				return err
+			}
+			if *end > 0 && res.Record.Offset >= *end {
+				return nil
+			}
+			if err = c.format.record(c.stdout, res.Record); err != nil {
+				return err
+			}
+		}
+	case *end > 0:
+		for next := *offset; next < *end; {
+			res, err := c.client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+				Offset:     next,
+				MaxRecords: *end - next,
+				Topic:      *topic,
+				Partition:  uint32(*partition),
+			})
+			if status.Code(err) == status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()) {
+				// the log ends before the range does
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, record := range res.Records {
+				if record.Offset >= *end {
+					return nil
+				}
+				if err = c.format.record(c.stdout, record); err != nil {
+					return err
+				}
+				next = record.Offset + 1
+			}
+		}
+		return nil
+	default:
+		res, err := c.client.Consume(ctx, req)
+		if err != nil {
+			return err
+		}
+		return c.format.record(c.stdout, res.Record)
+	}
+}
+
+// servers prints the cluster's servers, with the partitions each one leads.
+func (c *cli) servers(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	res, err := c.client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		return err
+	}
+	if c.format == jsonFormat {
+		for _, server := range res.Servers {
+			if err = c.format.message(c.stdout, server); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRPC ADDRESS\tROLE\tLEADS")
+	for _, server := range res.Servers {
+		role := "voter"
+		if server.Nonvoter {
+			role = "nonvoter"
+		}
+		leads := make([]string, 0, len(server.Leads))
+		for _, p := range server.Leads {
+			leads = append(leads, fmt.Sprint(p))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", server.Id, server.RpcAddr, role,
+			strings.Join(leads, ","))
+	}
+	return w.Flush()
+}
+
+// listValue is a flag.Value that collects the values of a repeated flag.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
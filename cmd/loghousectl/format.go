@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+)
+
+/*
+format is how records are printed, one per line:
+
+	raw   the record's value as it is
+	json  the record as JSON, with its key and value base64 encoded
+	hex   the record's value hex encoded
+
+Produced offsets are printed as numbers, or JSON objects in the json format.
+*/
+type format string
+
+const (
+	rawFormat  format = "raw"
+	jsonFormat format = "json"
+	hexFormat  format = "hex"
+)
+
+func (f *format) String() string {
+	if f == nil || *f == "" {
+		return string(rawFormat)
+	}
+	return string(*f)
+}
+
+func (f *format) Set(value string) error {
+	switch format(value) {
+	case rawFormat, jsonFormat, hexFormat:
+		*f = format(value)
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", value)
+}
+
+func (f format) record(w io.Writer, record *api.Record) error {
+	switch f {
+	case jsonFormat:
+		return f.message(w, record)
+	case hexFormat:
+		_, err := fmt.Fprintln(w, hex.EncodeToString(record.Value))
+		return err
+	default:
+		if _, err := w.Write(record.Value); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	}
+}
+
+func (f format) offset(w io.Writer, offset uint64) error {
+	if f == jsonFormat {
+		return f.message(w, &api.ProduceResponse{Offset: offset})
+	}
+	_, err := fmt.Fprintln(w, offset)
+	return err
+}
+
+// message prints m as one line of JSON, with fields named as in the proto
+// file and zero values left out. protojson varies its whitespace on purpose,
+// so the output is compacted to keep it stable for scripts.
+func (f format) message(w io.Writer, m proto.Message) error {
+	b, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err = json.Compact(&out, b); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(w)
+	return err
+}
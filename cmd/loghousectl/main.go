@@ -0,0 +1,160 @@
+/*
+loghousectl is a command-line client for Loghouse clusters.
+
+	loghousectl [flags] <command> [command flags] [args]
+
+The commands are:
+
+	produce   append records from arguments, files or stdin, one per line
+	consume   read a record, a range of records, or follow a partition
+	servers   list the cluster's servers
+
+The server is given with -addr, either directly as host:port or as
+loghouse:///host:port to discover the cluster through that server and route
+requests to the right servers. The global flags can also be set with LOGHOUSE_*
+environment variables: -addr with LOGHOUSE_ADDR, -tls-cert-file with
+LOGHOUSE_TLS_CERT_FILE, and so on.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/config"
+	_ "github.com/anshulsood11/loghouse/internal/loadbalance"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// envPrefix starts the names of the environment variables that set the global
+// flags.
+const envPrefix = "LOGHOUSE_"
+
+// cli runs the commands with a client of the cluster, reading input from stdin
+// and writing records to stdout in the format.
+type cli struct {
+	client api.LogClient
+	stdin  io.Reader
+	stdout io.Writer
+	format format
+}
+
+var commands = map[string]struct {
+	run   func(c *cli, ctx context.Context, args []string) error
+	usage string
+}{
+	"produce": {(*cli).produce, "append records from arguments, files or stdin, one per line"},
+	"consume": {(*cli).consume, "read a record, a range of records, or follow a partition"},
+	"servers": {(*cli).servers, "list the cluster's servers"},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:], os.Getenv, os.Stdin, os.Stdout)
+	stop()
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "loghousectl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, getenv func(string) string,
+	stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("loghousectl", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8400",
+		"Server address, or loghouse:///host:port to use the cluster's resolver.")
+	var tlsConfig config.TLSConfig
+	fs.StringVar(&tlsConfig.CertFile, "tls-cert-file", "", "Path to client tls cert.")
+	fs.StringVar(&tlsConfig.KeyFile, "tls-key-file", "", "Path to client tls key.")
+	fs.StringVar(&tlsConfig.CAFile, "tls-ca-file", "", "Path to certificate authority.")
+	fs.StringVar(&tlsConfig.ServerAddress, "tls-server-name", "",
+		"Name to verify the server's certificate against, the address's host by default.")
+	c := &cli{stdin: stdin, stdout: stdout, format: rawFormat}
+	fs.Var(&c.format, "format", "Output format: raw, json or hex.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: loghousectl [flags] <command> [command flags] [args]\n\n")
+		fmt.Fprintf(fs.Output(), "Commands:\n")
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(fs.Output(), "  %-10s%s\n", name, commands[name].usage)
+		}
+		fmt.Fprintf(fs.Output(), "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value := getenv(env); err == nil && !set[f.Name] && value != "" {
+			if err = fs.Set(f.Name, value); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, env, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	conn, err := dial(*addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.client = api.NewLogClient(conn)
+	return command.run(c, ctx, fs.Args()[1:])
+}
+
+/*
+dial connects to the server at addr, over TLS when a CA or client certificate
+is given. The server's certificate is verified against the address's host
+unless another name is given.
+*/
+func dial(addr string, tlsConfig config.TLSConfig) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig.CAFile != "" || tlsConfig.CertFile != "" {
+		if tlsConfig.ServerAddress == "" {
+			host, _, err := net.SplitHostPort(addr[strings.LastIndex(addr, "/")+1:])
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ServerAddress = host
+		}
+		c, err := config.SetupTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(c)
+	}
+	return grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+}
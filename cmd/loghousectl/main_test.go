@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/auth"
+	"github.com/anshulsood11/loghouse/internal/log"
+	"github.com/anshulsood11/loghouse/internal/server"
+	"github.com/anshulsood11/loghouse/internal/test_util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommands(t *testing.T) {
+	addr := setupServer(t)
+	env := map[string]string{
+		"LOGHOUSE_ADDR":          addr,
+		"LOGHOUSE_TLS_CERT_FILE": test_util.RootClientCertFile,
+		"LOGHOUSE_TLS_KEY_FILE":  test_util.RootClientKeyFile,
+		"LOGHOUSE_TLS_CA_FILE":   test_util.CAFile,
+	}
+	ctl := func(stdin string, args ...string) (string, error) {
+		var stdout bytes.Buffer
+		err := run(context.Background(), args, func(key string) string {
+			return env[key]
+		}, strings.NewReader(stdin), &stdout)
+		return stdout.String(), err
+	}
+
+	// records come from arguments, files or stdin, one per line
+	out, err := ctl("", "produce", "first", "second")
+	require.NoError(t, err)
+	require.Equal(t, "0\n1\n", out)
+	out, err = ctl("third\nfourth\n", "-format", "json", "produce")
+	require.NoError(t, err)
+	require.Equal(t, "{\"offset\":\"2\"}\n{\"offset\":\"3\"}\n", out)
+	file := filepath.Join(t.TempDir(), "records")
+	require.NoError(t, os.WriteFile(file, []byte("fifth\n"), 0644))
+	out, err = ctl("", "produce", "-file", file)
+	require.NoError(t, err)
+	require.Equal(t, "4\n", out)
+
+	out, err = ctl("", "consume", "-offset", "1")
+	require.NoError(t, err)
+	require.Equal(t, "second\n", out)
+	// ranges stop where the log does
+	out, err = ctl("", "consume", "-offset", "1", "-end", "10")
+	require.NoError(t, err)
+	require.Equal(t, "second\nthird\nfourth\nfifth\n", out)
+	out, err = ctl("", "-format", "hex", "consume", "-offset", "0", "-end", "1")
+	require.NoError(t, err)
+	require.Equal(t, "6669727374\n", out)
+	out, err = ctl("", "-format", "json", "consume", "-offset", "4")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out, `{"value":"ZmlmdGg=","offset":"4","timestamp":"`), out)
+	_, err = ctl("", "consume", "-offset", "10")
+	require.Error(t, err)
+
+	// following prints records as they're appended until it's interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, []string{"consume", "-f", "-offset", "3"}, func(key string) string {
+			return env[key]
+		}, nil, &stdout)
+	}()
+	_, err = ctl("", "produce", "sixth")
+	require.NoError(t, err)
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.Equal(t, "fourth\nfifth\nsixth\n", stdout.String())
+
+	out, err = ctl("", "servers")
+	require.NoError(t, err)
+	require.Equal(t, `ID  RPC ADDRESS     ROLE      LEADS
+0   127.0.0.1:1001  voter     0,2
+1   127.0.0.1:1002  nonvoter  
+`, out)
+	out, err = ctl("", "-format", "json", "servers")
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"0","rpc_addr":"127.0.0.1:1001","is_leader":true,"leads":[0,2]}
+{"id":"1","rpc_addr":"127.0.0.1:1002","nonvoter":true}
+`, out)
+
+	_, err = ctl("", "-format", "yaml", "servers")
+	require.Error(t, err)
+	_, err = ctl("", "unknown")
+	require.Error(t, err)
+}
+
+// servers is a ServersFetcher with a fixed cluster.
+type servers struct{}
+
+func (servers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{
+		{Id: "0", RpcAddr: "127.0.0.1:1001", IsLeader: true, Leads: []uint32{0, 2}},
+		{Id: "1", RpcAddr: "127.0.0.1:1002", Nonvoter: true},
+	}, nil
+}
+
+// setupServer runs a server with a single, unreplicated log and returns its
+// address.
+func setupServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile:      test_util.ServerCertFile,
+		KeyFile:       test_util.ServerKeyFile,
+		CAFile:        test_util.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	clog, err := log.NewPartitions(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:      clog,
+		Authorizer:     auth.NewAuthorizer(test_util.ACLModelFile, test_util.ACLPolicyFile),
+		ServersFetcher: servers{},
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		srv.Stop()
+		l.Close()
+		clog.Close()
+	})
+	return l.Addr().String()
+}
@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"bytes"
 	"crypto/tls"
 	"fmt"
 	"github.com/anshulsood11/loghouse/internal/auth"
@@ -26,6 +25,7 @@ type Agent struct {
 	mux          cmux.CMux
 	log          *log.DistributedLog
 	server       *grpc.Server
+	forwarder    *server.Forwarder
 	membership   *discovery.Membership
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -43,6 +43,19 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	// Partitions is the number of partitions topics are split into, which must
+	// be the same on every server in the cluster.
+	Partitions uint32
+	// Nonvoter makes the server a read replica, which replicates the log
+	// without slowing down commits or standing for leader.
+	Nonvoter bool
+	// DrainTimeout bounds how long Shutdown waits for in-flight requests, such
+	// as open streams, to finish before closing their connections. It defaults
+	// to 10 seconds.
+	DrainTimeout time.Duration
+	// FailedRemoveTimeout is how long other servers can be failed before
+	// they're removed from the Raft groups, as discovery.Config describes.
+	FailedRemoveTimeout time.Duration
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -57,6 +70,9 @@ func (c Config) RPCAddr() (string, error) {
 // the agent’s components. After we run New(), we expect to have a running,
 // functioning service.
 func NewAgent(config Config) (*Agent, error) {
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = 10 * time.Second
+	}
 	agent := &Agent{
 		Config:    config,
 		shutdowns: make(chan struct{}),
@@ -104,23 +120,54 @@ func (a *Agent) setupMux() error {
 	return nil
 }
 
+/*
+advertisedListener reports the RPC address as its own rather than the address
+it listens on, which covers every interface. Raft takes a server's address from
+its listener, and a server bootstrapping a group records that address for the
+others to reach it at.
+*/
+type advertisedListener struct {
+	net.Listener
+	addr net.Addr
+}
+
+func (l advertisedListener) Addr() net.Addr {
+	return l.addr
+}
+
+// advertisedAddr is a TCP address given as host and port, which needn't be an
+// IP address.
+type advertisedAddr string
+
+func (a advertisedAddr) Network() string {
+	return "tcp"
+}
+
+func (a advertisedAddr) String() string {
+	return string(a)
+}
+
 func (a *Agent) setupLog() error {
 	raftListener := a.mux.Match(func(reader io.Reader) bool {
 		b := make([]byte, 1)
 		if _, err := reader.Read(b); err != nil {
 			return false
 		}
-		return bytes.Compare(b, []byte{byte(log.RaftRPC)}) == 0
+		return b[0] == log.RaftRPC || b[0] == log.PartitionRaftRPC
 	})
+	rpcAddr, err := a.Config.RPCAddr()
+	if err != nil {
+		return err
+	}
 	logConfig := log.Config{}
 	logConfig.Raft.StreamLayer = log.NewStreamLayer(
-		raftListener,
+		advertisedListener{Listener: raftListener, addr: advertisedAddr(rpcAddr)},
 		a.Config.ServerTLSConfig,
 		a.Config.PeerTLSConfig,
 	)
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
-	var err error
+	logConfig.Partitions = a.Config.Partitions
 	a.log, err = log.NewDistributedLog(a.Config.DataDir, logConfig)
 	if err != nil {
 		return err
@@ -132,8 +179,21 @@ func (a *Agent) setupLog() error {
 }
 
 func (a *Agent) setupServer() error {
-	authorizer := auth.NewAuthorizer(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
-	serverConfig := &server.Config{CommitLog: a.log, Authorizer: authorizer, ServersFetcher: a.log}
+	// without an ACL, every client may make every request
+	var authorizer server.Authorizer = auth.AllowAll{}
+	if a.Config.ACLModelFile != "" || a.Config.ACLPolicyFile != "" {
+		authorizer = auth.NewAuthorizer(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	} else {
+		zap.L().Named("agent").Warn("no ACL configured, allowing every request")
+	}
+	a.forwarder = server.NewForwarder(a.log, a.Config.PeerTLSConfig)
+	serverConfig := &server.Config{
+		CommitLog:      a.log,
+		Authorizer:     authorizer,
+		ServersFetcher: a.log,
+		Forwarder:      a.forwarder,
+		RaftAdmin:      a.log,
+	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
 		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
@@ -158,17 +218,31 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
+	role := discovery.VoterRole
+	if a.Config.Nonvoter {
+		role = discovery.NonvoterRole
+	}
 	a.membership, err = discovery.NewMembership(a.log, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
+			"rpc_addr":        rpcAddr,
+			discovery.RoleTag: role,
 		},
-		StartJoinAddrs: a.Config.StartJoinAddrs,
+		StartJoinAddrs:      a.Config.StartJoinAddrs,
+		FailedRemoveTimeout: a.Config.FailedRemoveTimeout,
 	})
 	return err
 }
 
+/*
+Shutdown drains the agent before stopping it, so that rolling restarts don't
+leave the cluster without leaders: the server hands leadership of the groups it
+leads over to other servers first, and writes it gets from then on, including
+ones on open ProduceStreams, are forwarded to the new leaders. It then waits up
+to DrainTimeout for in-flight requests to finish, and only then leaves the
+cluster and closes the log.
+*/
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -178,11 +252,28 @@ func (a *Agent) Shutdown() error {
 	a.shutdown = true
 	close(a.shutdowns)
 	shutdown := []func() error{
-		a.membership.Leave,
 		func() error {
-			a.server.GracefulStop()
+			if err := a.log.DrainLeadership(); err != nil {
+				// the cluster elects new leaders without us, just more slowly
+				zap.L().Named("agent").Warn("failed to drain leadership", zap.Error(err))
+			}
 			return nil
 		},
+		func() error {
+			stopped := make(chan struct{})
+			go func() {
+				a.server.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(a.Config.DrainTimeout):
+				a.server.Stop()
+			}
+			return nil
+		},
+		a.membership.Leave,
+		a.forwarder.Close,
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
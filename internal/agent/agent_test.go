@@ -13,6 +13,7 @@ import (
 	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -26,12 +27,13 @@ func TestAgent(t *testing.T) {
 		ServerAddress: "127.0.0.1",
 	})
 	require.NoError(t, err)
+	// peers verify each other against the address they dial, as the
+	// loghouse command sets them up to
 	peerTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
-		CertFile:      test_util.RootClientCertFile,
-		KeyFile:       test_util.RootClientKeyFile,
-		CAFile:        test_util.CAFile,
-		Server:        false,
-		ServerAddress: "127.0.0.1",
+		CertFile: test_util.RootClientCertFile,
+		KeyFile:  test_util.RootClientKeyFile,
+		CAFile:   test_util.CAFile,
+		Server:   false,
 	})
 	require.NoError(t, err)
 
@@ -75,6 +77,19 @@ func TestAgent(t *testing.T) {
 	// wait for nodes to discover each other
 	time.Sleep(3 * time.Second)
 
+	// servers listen on every interface, but are known by their RPC address,
+	// the bootstrapping one included
+	servers, err := agents[2].log.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, len(agents), len(servers))
+	for _, server := range servers {
+		id, err := strconv.Atoi(server.Id)
+		require.NoError(t, err)
+		rpcAddr, err := agents[id].Config.RPCAddr()
+		require.NoError(t, err)
+		require.Equal(t, rpcAddr, server.RpcAddr)
+	}
+
 	leaderClient := client(t, agents[0], peerTLSConfig)
 	produceResponse, err := leaderClient.Produce(
 		context.Background(),
@@ -122,6 +137,79 @@ func TestAgent(t *testing.T) {
 	require.Nil(t, consumeResponse)
 	require.Error(t, err)
 	require.Equal(t, status.Code(err), status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()))
+
+	// followers forward writes from clients that don't route them to the leader
+	followerConn := directClient(t, agents[1], peerTLSConfig)
+	produceResponse, err = api.NewLogClient(followerConn).Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	// wait until the forwarded record has been replicated
+	time.Sleep(3 * time.Second)
+	consumeResponse, err = leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("bar"))
+	require.NoError(t, followerConn.Close())
+
+	// the leader hands its leadership over when it shuts down, and forwards
+	// writes on streams that are still open to the new leader
+	leaderConn := directClient(t, agents[0], peerTLSConfig)
+	defer leaderConn.Close()
+	stream, err := api.NewLogClient(leaderConn).ProduceStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("before")},
+	}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- agents[0].Shutdown()
+	}()
+	require.Eventually(t, func() bool {
+		servers, err := agents[1].log.GetServers()
+		if err != nil {
+			return false
+		}
+		for _, server := range servers {
+			if server.IsLeader {
+				return server.Id != "0"
+			}
+		}
+		return false
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("after")},
+	}))
+	produceResponse, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseSend())
+	require.NoError(t, <-shutdown)
+
+	// the remaining servers may take a moment to hear from the new leader
+	newLeaderClient := client(t, agents[1], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		consumeResponse, err = newLeaderClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Offset:      produceResponse.Offset,
+				Consistency: api.Consistency_LEADER_VERIFIED,
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, consumeResponse.Record.Value, []byte("after"))
 }
 
 func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
@@ -134,3 +222,13 @@ func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
 	client := api.NewLogClient(conn)
 	return client
 }
+
+// directClient connects to the agent without the loghouse resolver, so requests
+// go to that agent whether or not it's the leader.
+func directClient(t *testing.T, agent *Agent, tlsConfig *tls.Config) *grpc.ClientConn {
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(rpcAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	return conn
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 	"net"
+	"time"
 )
 
 /*
@@ -18,6 +19,10 @@ type Membership struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+	// failures has the timers that remove failed members, by name, and
+	// expired gets the names of the members whose timers fired.
+	failures map[string]*time.Timer
+	expired  chan string
 }
 
 type Config struct {
@@ -25,18 +30,42 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	// FailedRemoveTimeout is how long a member can stay failed, giving it the
+	// chance to come back, before it's removed from the cluster's Raft groups
+	// so that it no longer counts towards their quorums. It defaults to 30
+	// seconds. When it's negative, failed members are only removed once Serf
+	// reaps them.
+	FailedRemoveTimeout time.Duration
 }
 
+/*
+RoleTag is the tag servers advertise their role in the cluster with. Voters
+take part in committing writes and electing leaders, while nonvoters only
+replicate the log to serve reads. Servers without the tag are voters.
+*/
+const (
+	RoleTag      = "role"
+	VoterRole    = "voter"
+	NonvoterRole = "nonvoter"
+)
+
+// Handler is told about the servers that join and leave the cluster. Join's
+// voter says whether the server should vote.
 type Handler interface {
-	Join(name, addr string) error
+	Join(name, addr string, voter bool) error
 	Leave(name string) error
 }
 
 func NewMembership(handler Handler, config Config) (*Membership, error) {
+	if config.FailedRemoveTimeout == 0 {
+		config.FailedRemoveTimeout = 30 * time.Second
+	}
 	c := &Membership{
-		Config:  config,
-		handler: handler,
-		logger:  zap.L().Named("membership"),
+		Config:   config,
+		handler:  handler,
+		logger:   zap.L().Named("membership"),
+		failures: make(map[string]*time.Timer),
+		expired:  make(chan string),
 	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
@@ -84,34 +113,92 @@ func (m *Membership) setupSerf() (err error) {
 
 /*
 eventHandler() runs in a loop reading events sent by Serf into the events channel,
-handling each incoming event according to the event’s type. Serf may coalesce multiple
-members updates into one event, so we iterate over event's members.
+handling each incoming event according to the event’s type, until Serf shuts down.
+Serf may coalesce multiple members updates into one event, so we iterate over event's
+members. Events about the local member are skipped.
+
+Members that join, or update their tags, for example to change their RPC address
+or role, are joined again, which updates the Raft groups to match. Members that
+leave, or that Serf reaps after they've been failed for long enough, are removed.
+Members that fail are removed after FailedRemoveTimeout unless they come back
+before then.
 */
 func (m *Membership) eventHandler() {
-	for e := range m.events {
-		switch e.EventType() {
-		case serf.EventMemberJoin:
-			for _, member := range e.(serf.MemberEvent).Members {
+	for {
+		select {
+		case e := <-m.events:
+			me, ok := e.(serf.MemberEvent)
+			if !ok {
+				continue
+			}
+			for _, member := range me.Members {
 				if m.isLocal(member) {
 					continue
 				}
-				if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
-					m.logError(err, "failed to join", member)
-				}
+				m.handleEvent(me.EventType(), member)
 			}
-		case serf.EventMemberLeave:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					return
-				}
-				if err := m.handler.Leave(member.Name); err != nil {
-					m.logError(err, "failed to leave", member)
+		case name := <-m.expired:
+			delete(m.failures, name)
+			for _, member := range m.serf.Members() {
+				// the member may have come back since its timer was set
+				if member.Name == name && member.Status == serf.StatusFailed {
+					m.leave(member)
 				}
 			}
+		case <-m.serf.ShutdownCh():
+			for _, timer := range m.failures {
+				timer.Stop()
+			}
+			return
 		}
 	}
 }
 
+func (m *Membership) handleEvent(eventType serf.EventType, member serf.Member) {
+	switch eventType {
+	case serf.EventMemberJoin, serf.EventMemberUpdate:
+		m.cancelFailure(member.Name)
+		voter := member.Tags[RoleTag] != NonvoterRole
+		if err := m.handler.Join(member.Name, member.Tags["rpc_addr"], voter); err != nil {
+			m.logError(err, "failed to join", member)
+		}
+	case serf.EventMemberLeave, serf.EventMemberReap:
+		m.cancelFailure(member.Name)
+		m.leave(member)
+	case serf.EventMemberFailed:
+		if m.FailedRemoveTimeout < 0 {
+			return
+		}
+		if _, ok := m.failures[member.Name]; ok {
+			return
+		}
+		m.logger.Warn("member failed", zap.String("name", member.Name),
+			zap.Duration("remove_after", m.FailedRemoveTimeout))
+		name := member.Name
+		m.failures[name] = time.AfterFunc(m.FailedRemoveTimeout, func() {
+			select {
+			case m.expired <- name:
+			case <-m.serf.ShutdownCh():
+			}
+		})
+	}
+}
+
+// cancelFailure stops the removal of a failed member that came back or left
+// for good.
+func (m *Membership) cancelFailure(name string) {
+	if timer, ok := m.failures[name]; ok {
+		timer.Stop()
+		delete(m.failures, name)
+	}
+}
+
+func (m *Membership) leave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	log := m.logger.Error
 	// If the node is a non-leader we will log the errors at the debug level, but
@@ -130,6 +217,12 @@ func (m *Membership) isLocal(member serf.Member) bool {
 func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
+
+// Leave tells the other members that this member is leaving the cluster, and
+// shuts Serf down.
 func (m *Membership) Leave() error {
-	return m.serf.Leave()
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.serf.Shutdown()
 }
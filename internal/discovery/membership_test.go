@@ -26,6 +26,61 @@ func TestMembership(t *testing.T) {
 			1 == len(handler.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
+	// servers join as voters unless they say they're nonvoters
+	joins := map[string]string{}
+	for i := 0; i < 2; i++ {
+		join := <-handler.joins
+		joins[join["id"]] = join["voter"]
+	}
+	require.Equal(t, map[string]string{"1": "true", "2": "false"}, joins)
+}
+
+func TestMembershipFailures(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return 2 == len(handler.joins)
+	}, 3*time.Second, 250*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		<-handler.joins
+	}
+
+	// members that change their tags are joined again with them
+	ports := test_util.GetFreePorts(1)
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+	require.NoError(t, m[1].serf.SetTags(map[string]string{
+		"rpc_addr": addr,
+		RoleTag:    NonvoterRole,
+	}))
+	select {
+	case join := <-handler.joins:
+		require.Equal(t, map[string]string{"id": "1", "addr": addr, "voter": "false"}, join)
+	case <-time.After(5 * time.Second):
+		t.Fatal("updated member wasn't joined again")
+	}
+
+	// members that fail are removed once they've been failed for a while
+	require.NoError(t, m[1].serf.Shutdown())
+	select {
+	case id := <-handler.leaves:
+		require.Equal(t, "1", id)
+	case <-time.After(15 * time.Second):
+		t.Fatal("failed member wasn't removed")
+	}
+	for _, member := range m[0].Members() {
+		if member.Name == "1" {
+			require.Equal(t, serf.StatusFailed, member.Status)
+		}
+	}
+
+	require.NoError(t, m[2].Leave())
+	select {
+	case id := <-handler.leaves:
+		require.Equal(t, "2", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("leaving member wasn't removed")
+	}
 }
 
 func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
@@ -35,14 +90,19 @@ func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler)
 	tags := map[string]string{
 		"rpc_addr": addr,
 	}
+	// the third member is a read replica
+	if id == 2 {
+		tags[RoleTag] = NonvoterRole
+	}
 	c := Config{
-		NodeName: fmt.Sprintf("%d", id),
-		BindAddr: addr,
-		Tags:     tags,
+		NodeName:            fmt.Sprintf("%d", id),
+		BindAddr:            addr,
+		Tags:                tags,
+		FailedRemoveTimeout: 100 * time.Millisecond,
 	}
 	h := &handler{}
-	h.joins = make(chan map[string]string, 3)
-	h.leaves = make(chan string, 3)
+	h.joins = make(chan map[string]string, 10)
+	h.leaves = make(chan string, 10)
 	if len(members) != 0 {
 		c.StartJoinAddrs = []string{
 			members[0].BindAddr,
@@ -59,11 +119,12 @@ type handler struct {
 	leaves chan string
 }
 
-func (h *handler) Join(id, addr string) error {
+func (h *handler) Join(id, addr string, voter bool) error {
 	if h.joins != nil {
 		h.joins <- map[string]string{
-			"id":   id,
-			"addr": addr,
+			"id":    id,
+			"addr":  addr,
+			"voter": fmt.Sprintf("%t", voter),
 		}
 	}
 	return nil
@@ -12,7 +12,10 @@ type Picker struct {
 	mu        sync.RWMutex
 	leader    balancer.SubConn
 	followers []balancer.SubConn
-	current   uint64
+	// replicas are the nonvoting servers, which take the reads off the voters
+	// when there are any.
+	replicas []balancer.SubConn
+	current  uint64
 }
 
 var _ base.PickerBuilder = (*Picker)(nil)
@@ -21,16 +24,21 @@ var _ balancer.Picker = (*Picker)(nil)
 func (p *Picker) Build(info base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	var followers []balancer.SubConn
+	var followers, replicas []balancer.SubConn
 	for sc, scInfo := range info.ReadySCs {
 		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
 		if isLeader {
 			p.leader = sc
 			continue
 		}
+		if nonvoter, _ := scInfo.Address.Attributes.Value("nonvoter").(bool); nonvoter {
+			replicas = append(replicas, sc)
+			continue
+		}
 		followers = append(followers, sc)
 	}
 	p.followers = followers
+	p.replicas = replicas
 	return p
 }
 
@@ -38,9 +46,20 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") || len(p.followers) == 0 {
+	method := info.FullMethodName
+	if strings.Contains(method, "Produce") ||
+		strings.HasSuffix(method, "/CreateTopic") ||
+		strings.HasSuffix(method, "/DeleteTopic") ||
+		strings.HasSuffix(method, "/CommitOffset") ||
+		strings.HasSuffix(method, "Group") ||
+		strings.HasSuffix(method, "/Heartbeat") ||
+		len(p.followers)+len(p.replicas) == 0 {
+		// only the leader can change the log, and consumer groups are kept by
+		// the server their members talk to, so they all talk to the leader
 		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
+	} else if strings.Contains(method, "Consume") ||
+		strings.HasSuffix(method, "/ListTopics") ||
+		strings.HasSuffix(method, "/FetchOffset") {
 		result.SubConn = p.nextFollower()
 	}
 	if result.SubConn == nil {
@@ -49,11 +68,17 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	return result, nil
 }
 
+// nextFollower picks the replicas in turn, or the followers when there are no
+// replicas.
 func (p *Picker) nextFollower() balancer.SubConn {
+	followers := p.replicas
+	if len(followers) == 0 {
+		followers = p.followers
+	}
 	cur := atomic.AddUint64(&p.current, uint64(1))
-	len := uint64(len(p.followers))
+	len := uint64(len(followers))
 	idx := int(cur % len)
-	return p.followers[idx]
+	return followers[idx]
 }
 
 func init() {
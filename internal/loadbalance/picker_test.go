@@ -48,6 +48,51 @@ func TestPickerConsumesFromFollowers(t *testing.T) {
 	}
 }
 
+func TestPickerRoutesTopicRequests(t *testing.T) {
+	picker, subConns := setupTest()
+	for method, leader := range map[string]bool{
+		"/log.vX.Log/CreateTopic":  true,
+		"/log.vX.Log/DeleteTopic":  true,
+		"/log.vX.Log/ListTopics":   false,
+		"/log.vX.Log/CommitOffset": true,
+		"/log.vX.Log/FetchOffset":  false,
+		"/log.vX.Log/JoinGroup":    true,
+		"/log.vX.Log/Heartbeat":    true,
+		"/log.vX.Log/LeaveGroup":   true,
+	} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err)
+		require.Equal(t, leader, pick.SubConn == subConns[0], method)
+	}
+}
+
+func TestPickerConsumesFromReplicas(t *testing.T) {
+	picker, subConns := setupTest()
+	// a fourth server joins as a read replica
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for _, sc := range subConns {
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: sc.addrs[0]}
+	}
+	replica := &subConn{}
+	addr := resolver.Address{
+		Attributes: attributes.New("is_leader", false).WithValue("nonvoter", true),
+	}
+	replica.UpdateAddresses([]resolver.Address{addr})
+	buildInfo.ReadySCs[replica] = base.SubConnInfo{Address: addr}
+	picker.Build(buildInfo)
+
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Consume"})
+		require.NoError(t, err)
+		require.Equal(t, replica, pick.SubConn)
+	}
+	pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Produce"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
+}
+
 func setupTest() (*Picker, []*subConn) {
 	var subConns []*subConn
 	buildInfo := base.PickerBuildInfo{
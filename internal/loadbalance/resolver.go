@@ -30,6 +30,9 @@ const Name = "loghouse"
 // with the servers it discovers.
 func (r *Resolver) Build(target resolver.Target, cc resolver.ClientConn,
 	opts resolver.BuildOptions) (resolver.Resolver, error) {
+	// the registered Resolver builds the resolvers of every client connection,
+	// which resolve concurrently, so each gets a Resolver of its own
+	r = &Resolver{}
 	r.logger = zap.L().Named("resolver")
 	// clientConn connection is the user’s client connection and gRPC passes it
 	// to the resolver for the resolver to update with the servers it discovers.
@@ -80,8 +83,9 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 	var addrs []resolver.Address
 	for _, server := range res.Servers {
 		addrs = append(addrs, resolver.Address{
-			Addr:       server.RpcAddr,
-			Attributes: attributes.New("is_leader", server.IsLeader),
+			Addr: server.RpcAddr,
+			Attributes: attributes.New("is_leader", server.IsLeader).
+				WithValue("nonvoter", server.Nonvoter),
 		})
 	}
 	err = r.clientConn.UpdateState(resolver.State{
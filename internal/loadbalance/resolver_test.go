@@ -50,29 +50,40 @@ func TestResolver(t *testing.T) {
 		DialCreds: clientCreds,
 	}
 	r := Resolver{}
-
-	_, err = r.Build(
-		resolver.Target{
-			URL: url.URL{
-				Path: l.Addr().String(),
-			},
+	target := resolver.Target{
+		URL: url.URL{
+			Path: l.Addr().String(),
 		},
-		conn,
-		opts,
-	)
+	}
+
+	res, err := r.Build(target, conn, opts)
 	require.NoError(t, err)
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
 			Addr:       "localhost:9001",
-			Attributes: attributes.New("is_leader", true),
+			Attributes: attributes.New("is_leader", true).WithValue("nonvoter", false),
 		}, {
 			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
+			Attributes: attributes.New("is_leader", false).WithValue("nonvoter", false),
+		}, {
+			Addr:       "localhost:9003",
+			Attributes: attributes.New("is_leader", false).WithValue("nonvoter", true),
 		}},
 	}
 	require.Equal(t, wantState, conn.state)
 	conn.state.Addresses = nil
-	r.ResolveNow(resolver.ResolveNowOptions{})
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, wantState, conn.state)
+
+	// every client connection is built a resolver of its own, so another one
+	// doesn't take the first one's place
+	other := &clientConn{}
+	otherRes, err := r.Build(target, other, opts)
+	require.NoError(t, err)
+	defer otherRes.Close()
+	require.Equal(t, wantState, other.state)
+	conn.state.Addresses = nil
+	res.ResolveNow(resolver.ResolveNowOptions{})
 	require.Equal(t, wantState, conn.state)
 }
 
@@ -88,6 +99,10 @@ func (s *serversFetcherImpl) GetServers() ([]*api.Server, error) {
 	}, {
 		Id:      "follower",
 		RpcAddr: "localhost:9002",
+	}, {
+		Id:       "replica",
+		RpcAddr:  "localhost:9003",
+		Nonvoter: true,
 	}}, nil
 }
 
@@ -0,0 +1,155 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/hashicorp/raft"
+	"strconv"
+	"time"
+)
+
+/*
+The methods below administer the partitions' Raft groups for operators, on top
+of the membership changes Serf's events make. Changes to a group's membership or
+leadership have to be made by its leader and fail with api.ErrNotLeader on
+other servers.
+*/
+
+// group returns the partition's Raft group.
+func (l *DistributedLog) group(partition uint32) (*raft.Raft, error) {
+	if partition >= l.PartitionCount() {
+		return nil, api.ErrPartitionNotFound{Partition: partition}
+	}
+	return l.rafts[partition], nil
+}
+
+// leaderGroup returns the partition's Raft group if this server leads it.
+func (l *DistributedLog) leaderGroup(partition uint32) (*raft.Raft, error) {
+	r, err := l.group(partition)
+	if err != nil {
+		return nil, err
+	}
+	if r.State() != raft.Leader {
+		return nil, api.ErrNotLeader{Partition: partition}
+	}
+	return r, nil
+}
+
+// notLeader turns the errors Raft returns when this server isn't, or stops
+// being, the group's leader into api.ErrNotLeader.
+func notLeader(partition uint32, err error) error {
+	if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+		return api.ErrNotLeader{Partition: partition}
+	}
+	return err
+}
+
+// TransferLeadership hands the leadership of the partition's group over to the
+// server with the given ID, or to the most up to date voter when id is empty.
+func (l *DistributedLog) TransferLeadership(partition uint32, id string) error {
+	r, err := l.leaderGroup(partition)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return notLeader(partition, r.LeadershipTransfer().Error())
+	}
+	if raft.ServerID(id) == l.config.Raft.LocalID {
+		// the server already leads the group
+		return nil
+	}
+	future := r.GetConfiguration()
+	if err = future.Error(); err != nil {
+		return err
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == raft.ServerID(id) {
+			return notLeader(partition,
+				r.LeadershipTransferToServer(server.ID, server.Address).Error())
+		}
+	}
+	return api.ErrServerNotFound{Partition: partition, ID: id}
+}
+
+// RemoveServer removes the server from the partition's group.
+func (l *DistributedLog) RemoveServer(partition uint32, id string) error {
+	r, err := l.leaderGroup(partition)
+	if err != nil {
+		return err
+	}
+	return notLeader(partition, r.RemoveServer(raft.ServerID(id), 0, 0).Error())
+}
+
+// AddServer adds the server to the partition's group as a voter or a
+// nonvoter, or changes its suffrage if it's already in the group.
+func (l *DistributedLog) AddServer(partition uint32, id, addr string, voter bool) error {
+	r, err := l.leaderGroup(partition)
+	if err != nil {
+		return err
+	}
+	return notLeader(partition, join(r, id, addr, voter))
+}
+
+// RaftConfiguration returns the servers in the partition's group as this server
+// knows them, with this server's status.
+func (l *DistributedLog) RaftConfiguration(partition uint32) ([]*api.RaftServer, error) {
+	r, err := l.group(partition)
+	if err != nil {
+		return nil, err
+	}
+	future := r.GetConfiguration()
+	if err = future.Error(); err != nil {
+		return nil, err
+	}
+	leaderAddr, _ := r.LeaderWithID()
+	var servers []*api.RaftServer
+	for _, server := range future.Configuration().Servers {
+		s := &api.RaftServer{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			Nonvoter: server.Suffrage == raft.Nonvoter,
+			IsLeader: server.Address == leaderAddr,
+		}
+		if server.ID == l.config.Raft.LocalID {
+			if s.Status, err = l.RaftStatus(partition); err != nil {
+				return nil, err
+			}
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// RaftStatus returns this server's view of the partition's group.
+func (l *DistributedLog) RaftStatus(partition uint32) (*api.RaftStatus, error) {
+	r, err := l.group(partition)
+	if err != nil {
+		return nil, err
+	}
+	status := &api.RaftStatus{
+		State:        r.State().String(),
+		CommitIndex:  r.CommitIndex(),
+		AppliedIndex: r.AppliedIndex(),
+		LastIndex:    r.LastIndex(),
+	}
+	status.Term, _ = strconv.ParseUint(r.Stats()["term"], 10, 64)
+	if r.State() != raft.Leader {
+		if contact := r.LastContact(); !contact.IsZero() {
+			status.LastContactMs = time.Since(contact).Milliseconds()
+		}
+	}
+	return status, nil
+}
+
+// Snapshot has the partition's group take a snapshot on this server, which
+// lets Raft drop the log entries the snapshot covers.
+func (l *DistributedLog) Snapshot(partition uint32) error {
+	r, err := l.group(partition)
+	if err != nil {
+		return err
+	}
+	if err = r.Snapshot().Error(); err == raft.ErrNothingNewToSnapshot {
+		// the latest snapshot is already up to date
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/test_util"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRaftAdmin(t *testing.T) {
+	var nodes []*DistributedLog
+	var addrs []string
+	nodeCount := 3
+	ports := test_util.GetFreePorts(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "raft-admin-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(listener, nil, nil)
+		config.Raft.LocalID = raft.ServerID(strconv.Itoa(i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		node, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer node.Close()
+		if i == 0 {
+			require.NoError(t, node.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, nodes[0].Join(strconv.Itoa(i), listener.Addr().String(), true))
+		}
+		nodes = append(nodes, node)
+		addrs = append(addrs, listener.Addr().String())
+	}
+	// leader returns the index of the server that leads the group
+	leader := func() int {
+		for i, node := range nodes {
+			if node.rafts[0].State() == raft.Leader {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// only the leader can change the group
+	require.Equal(t, api.ErrNotLeader{Partition: 0}, nodes[1].TransferLeadership(0, "2"))
+	require.Equal(t, api.ErrServerNotFound{Partition: 0, ID: "9"},
+		nodes[0].TransferLeadership(0, "9"))
+	require.Equal(t, api.ErrPartitionNotFound{Partition: 1}, nodes[0].TransferLeadership(1, ""))
+	require.NoError(t, nodes[0].TransferLeadership(0, "0"))
+
+	require.NoError(t, nodes[0].TransferLeadership(0, "1"))
+	require.Eventually(t, func() bool {
+		return leader() == 1
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the configuration has every server, with the local server's status
+	servers, err := nodes[1].RaftConfiguration(0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	for i, server := range servers {
+		require.Equal(t, strconv.Itoa(i), server.Id)
+		require.Equal(t, addrs[i], server.RpcAddr)
+		require.Equal(t, i == 1, server.IsLeader)
+		require.False(t, server.Nonvoter)
+		require.Equal(t, i == 1, server.Status != nil)
+	}
+	require.Equal(t, raft.Leader.String(), servers[1].Status.State)
+	status, err := nodes[0].RaftStatus(0)
+	require.NoError(t, err)
+	require.Equal(t, raft.Follower.String(), status.State)
+	require.True(t, status.Term > 1)
+	require.True(t, status.LastIndex >= status.CommitIndex)
+
+	// servers can be removed, and added back as replicas
+	require.NoError(t, nodes[1].RemoveServer(0, "2"))
+	servers, err = nodes[1].RaftConfiguration(0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+	require.Eventually(t, func() bool {
+		i := leader()
+		return i >= 0 && nodes[i].AddServer(0, "2", addrs[2], false) == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	servers, err = nodes[leader()].RaftConfiguration(0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.True(t, servers[2].Nonvoter)
+
+	// snapshots can be taken on any server, even with nothing new to snapshot
+	require.NoError(t, nodes[0].Snapshot(0))
+	require.NoError(t, nodes[0].Snapshot(0))
+}
@@ -0,0 +1,225 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CompactionReport describes the segments rewritten by a compaction pass.
+type CompactionReport struct {
+	Segments int
+	Records  uint64
+	Bytes    uint64
+}
+
+/*
+Compact rewrites the closed segments to keep only the latest record for each
+key. Records without a key are always kept, and so is the last record of every
+segment so that the segment still knows where it ends. A tombstone, a record
+with a key and no value, is kept as the key's latest record until it's older
+than Compaction.TombstoneRetention, after which it's removed too.
+
+Records keep their offsets, so a compacted log has gaps; Read skips over them.
+The active segment is never compacted. The background compactor calls this
+every Compaction.Interval when compaction is enabled.
+*/
+func (l *Log) Compact() (CompactionReport, error) {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	var report CompactionReport
+	l.mu.RLock()
+	closed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	end := l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	if len(closed) == 0 {
+		return report, nil
+	}
+	latest, err := l.latestOffsets(closed[0].baseOffset, end)
+	if err != nil {
+		return report, err
+	}
+	tombstoneCutoff := time.Now().Add(-l.Config.Compaction.TombstoneRetention).UnixNano()
+	for _, s := range closed {
+		removed, bytes, err := l.compactSegment(s, func(record *api.Record) bool {
+			if len(record.Key) == 0 || record.Offset == s.nextOffset-1 {
+				return true
+			}
+			if latest[string(record.Key)] != record.Offset {
+				return false
+			}
+			return len(record.Value) != 0 || record.Timestamp >= tombstoneCutoff
+		})
+		if err != nil {
+			return report, err
+		}
+		if removed == 0 {
+			continue
+		}
+		report.Segments++
+		report.Records += removed
+		report.Bytes += bytes
+	}
+	if report.Segments > 0 {
+		zap.L().Named("log").Info(
+			"compacted segments",
+			zap.String("dir", l.Dir),
+			zap.Int("segments", report.Segments),
+			zap.Uint64("records", report.Records),
+			zap.Uint64("bytes", report.Bytes),
+		)
+	}
+	return report, nil
+}
+
+// latestOffsets returns the offset of the latest record for each key between
+// from and end.
+func (l *Log) latestOffsets(from, end uint64) (map[string]uint64, error) {
+	latest := make(map[string]uint64)
+	for off := from; off < end; off++ {
+		record, err := l.Read(off)
+		if errors.As(err, &api.ErrCorruptRecord{}) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record.Key) > 0 {
+			latest[string(record.Key)] = record.Offset
+		}
+		off = record.Offset
+	}
+	return latest, nil
+}
+
+/*
+compactSegment writes the records of s that keep accepts into a new segment in
+a scratch directory and, if any records were left out, swaps it in for s. It
+returns the number of records and store bytes removed. Segments with corrupt
+records are left as they are since we can't copy those records over.
+*/
+func (l *Log) compactSegment(s *segment, keep func(*api.Record) bool) (
+	removed, bytes uint64, err error) {
+	scratch := filepath.Join(l.Dir, fmt.Sprintf("%d.compacting", s.baseOffset))
+	if err = os.MkdirAll(scratch, 0755); err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(scratch)
+	compacted, err := newSegment(scratch, s.baseOffset, l.Config)
+	if err != nil {
+		return 0, 0, err
+	}
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if errors.As(err, &api.ErrCorruptRecord{}) {
+			zap.L().Named("log").Warn(
+				"skipping compaction of segment with a corrupt record",
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Uint64("offset", off),
+			)
+			return 0, 0, compacted.Close()
+		}
+		if err != nil {
+			_ = compacted.Close()
+			return 0, 0, err
+		}
+		off = record.Offset
+		if !keep(record) {
+			removed++
+			continue
+		}
+		compacted.nextOffset = record.Offset
+		if _, err = compacted.Append(record); err != nil {
+			_ = compacted.Close()
+			return 0, 0, err
+		}
+	}
+	if removed == 0 {
+		return 0, 0, compacted.Close()
+	}
+	if compacted.store.size < s.store.size {
+		bytes = s.store.size - compacted.store.size
+	}
+	if err = compacted.Sync(); err != nil {
+		_ = compacted.Close()
+		return 0, 0, err
+	}
+	if err = compacted.Close(); err != nil {
+		return 0, 0, err
+	}
+	// Renaming the directory is the point of no return: once there's a swap
+	// directory, finishCompactions completes the swap even after a crash.
+	swap := filepath.Join(l.Dir, fmt.Sprintf("%d.swap", s.baseOffset))
+	if err = os.Rename(scratch, swap); err != nil {
+		return 0, 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err = s.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err = finishSwap(swap, l.Dir); err != nil {
+		return 0, 0, err
+	}
+	swapped, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, segment := range l.segments {
+		if segment == s {
+			l.segments[i] = swapped
+		}
+	}
+	return removed, bytes, nil
+}
+
+/*
+finishCompactions cleans up after compactions that were interrupted. Scratch
+directories are incomplete and are thrown away, while swap directories hold
+whole compacted segments that still have to replace the originals.
+*/
+func (l *Log) finishCompactions() error {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		dir := filepath.Join(l.Dir, file.Name())
+		switch filepath.Ext(file.Name()) {
+		case ".compacting":
+			err = os.RemoveAll(dir)
+		case ".swap":
+			err = finishSwap(dir, l.Dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishSwap moves the compacted segment's files from the swap directory over
+// the original segment's files and removes the swap directory.
+func finishSwap(swap, dir string) error {
+	files, err := ioutil.ReadDir(swap)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Rename(
+			filepath.Join(swap, file.Name()),
+			filepath.Join(dir, file.Name()),
+		); err != nil {
+			return err
+		}
+	}
+	return os.Remove(swap)
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")}, // 0: superseded by 4
+		{Key: []byte("b"), Value: []byte("b1")}, // 1: superseded by 5
+		{Value: []byte("no key")},               // 2: kept, no key
+		{Key: []byte("c"), Value: []byte("c1")}, // 3: kept, last in segment
+		{Key: []byte("a"), Value: []byte("a2")}, // 4: latest for a
+		{Key: []byte("b"), Timestamp: old},      // 5: expired tombstone
+		{Key: []byte("d")},                      // 6: recent tombstone
+		{Key: []byte("c"), Value: []byte("c2")}, // 7: kept, last in segment
+		{Key: []byte("e"), Value: []byte("e1")}, // 8: active segment
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	report, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, CompactionReport{
+		Segments: 2,
+		Records:  3,
+		Bytes:    report.Bytes,
+	}, report)
+	require.NotZero(t, report.Bytes)
+
+	kept := []uint64{2, 3, 4, 6, 7, 8}
+	requireOffsets := func(log *Log) {
+		t.Helper()
+		var got []uint64
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		for off := lowest; off < 9; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, records[record.Offset].Value, record.Value)
+			got = append(got, record.Offset)
+			off = record.Offset
+		}
+		require.Equal(t, kept, got)
+
+		records, err := log.ReadRange(lowest, uint64(len(kept)), 0)
+		require.NoError(t, err)
+		got = nil
+		for _, record := range records {
+			got = append(got, record.Offset)
+		}
+		require.Equal(t, kept, got)
+	}
+	requireOffsets(log)
+
+	// compacted segments keep their offsets when the log is reopened
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	requireOffsets(log)
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+
+	// a second pass has nothing left to remove
+	report, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, CompactionReport{}, report)
+
+	// restoring a snapshot of the compacted log keeps the gaps, and the
+	// restored log starts at the first record that's left
+	restoreDir, err := ioutil.TempDir("", "compaction-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	topics, err := NewTopics(restoreDir, c)
+	require.NoError(t, err)
+	err = fsm{partitions: Partitions{topics}}.Restore(io.NopCloser(log.Reader()))
+	require.NoError(t, err)
+	restored, err := topics.Topic(DefaultTopic)
+	require.NoError(t, err)
+	requireOffsets(restored)
+	require.NoError(t, topics.Close())
+	require.NoError(t, log.Close())
+}
+
+func TestFinishCompactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "finish-compactions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "a", "b"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// a compaction that died before it was complete is thrown away
+	require.NoError(t, os.MkdirAll(dir+"/2.compacting", 0755))
+	// a compaction that died while swapping in the new segment is finished
+	require.NoError(t, os.MkdirAll(dir+"/0.swap", 0755))
+	swap, err := newSegment(dir+"/0.swap", 0, log.Config)
+	require.NoError(t, err)
+	swap.nextOffset = 1
+	_, err = swap.Append(&api.Record{Key: []byte("a"), Value: []byte("a")})
+	require.NoError(t, err)
+	require.NoError(t, swap.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	_, err = os.Stat(dir + "/0.swap")
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "/2.compacting")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,114 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"sync"
+)
+
+var (
+	// The zstd encoder and decoder are safe for concurrent use and expensive to
+	// create, so every segment shares one of each, created on first use.
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// ParseCodec returns the codec with the given name, as returned by String.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// compress returns p compressed with codec c.
+func compress(c Codec, p []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	case CodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(p, nil), nil
+	}
+	return nil, fmt.Errorf("unknown codec %d", c)
+}
+
+/*
+decompress returns p decompressed with codec c. The frame's checksum has already
+been verified by then, so data that doesn't decompress was written that way or
+with a codec we don't know; either way it's reported as a corrupt frame.
+*/
+func decompress(c Codec, p []byte) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(p)); err == nil {
+			b, err = ioutil.ReadAll(r)
+		}
+	case CodecSnappy:
+		b, err = snappy.Decode(nil, p)
+	case CodecZstd:
+		if err = initZstd(); err != nil {
+			return nil, err
+		}
+		b, err = zstdDecoder.DecodeAll(p, nil)
+	default:
+		err = fmt.Errorf("unknown codec %d", c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errCorruptFrame, c, err)
+	}
+	return b, nil
+}
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
@@ -0,0 +1,38 @@
+package log
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	p := bytes.Repeat([]byte(`{"hello":"world"}`), 64)
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			compressed, err := compress(codec, p)
+			require.NoError(t, err)
+			if codec != CodecNone {
+				require.Less(t, len(compressed), len(p))
+			}
+			got, err := decompress(codec, compressed)
+			require.NoError(t, err)
+			require.Equal(t, p, got)
+
+			parsed, err := ParseCodec(codec.String())
+			require.NoError(t, err)
+			require.Equal(t, codec, parsed)
+		})
+	}
+}
+
+func TestCompressionErrors(t *testing.T) {
+	_, err := compress(Codec(42), write)
+	require.Error(t, err)
+	_, err = decompress(Codec(42), write)
+	require.ErrorIs(t, err, errCorruptFrame)
+	_, err = decompress(CodecGzip, write)
+	require.ErrorIs(t, err, errCorruptFrame)
+	_, err = ParseCodec("lz4")
+	require.Error(t, err)
+}
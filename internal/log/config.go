@@ -1,16 +1,22 @@
 package log
 
 import (
-	"bytes"
 	"crypto/tls"
 	"fmt"
 	"github.com/hashicorp/raft"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 type Config struct {
-	Raft struct {
+	// Partitions is the number of partitions every topic is split into. Each
+	// partition has its own Raft group, so that the groups' leaders can be spread
+	// across servers. Every server in a cluster must use the same number, and it
+	// can't be changed once the cluster has data. Defaults to 1.
+	Partitions uint32
+	Raft       struct {
 		raft.Config
 		StreamLayer *StreamLayer
 		Bootstrap   bool
@@ -19,13 +25,91 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// SyncPolicy decides when appended records are fsynced to disk. SyncEvery
+		// and SyncInterval configure the SyncEveryN and SyncOnInterval policies.
+		SyncPolicy   SyncPolicy
+		SyncEvery    uint64
+		SyncInterval time.Duration
+		// TimeIndexInterval is the number of store bytes between time index
+		// entries. Smaller intervals make OffsetForTime read fewer records.
+		TimeIndexInterval uint64
+		// Codec compresses appended records. Every record's codec is stored with
+		// it, so changing the codec keeps older records readable.
+		Codec Codec
+	}
+	// Retention limits how much of the log is kept. Whole segments are removed,
+	// oldest first, once the log exceeds any of the limits; zero disables a limit.
+	// The active segment is never removed.
+	Retention struct {
+		// MaxBytes caps the total size of the log's store files.
+		MaxBytes uint64
+		// MaxSegmentAge removes segments whose newest record is older than this.
+		MaxSegmentAge time.Duration
+		// MaxRecords caps the number of records in the log.
+		MaxRecords uint64
+		// CheckInterval is how often the background cleaner runs.
+		CheckInterval time.Duration
+	}
+	// Compaction keeps only the latest record for each key in closed segments.
+	Compaction struct {
+		Enabled bool
+		// TombstoneRetention is how long a record with a key and no value is
+		// kept, so that readers get to see the key's deletion. Defaults to a day.
+		TombstoneRetention time.Duration
+		// Interval is how often the background compactor runs.
+		Interval time.Duration
 	}
 }
 
+// SyncPolicy trades append latency for durability. Records that haven't been
+// synced yet can be lost if the machine crashes.
+type SyncPolicy uint8
+
+const (
+	// SyncNever leaves flushing to the OS; records are only synced when Log.Sync
+	// is called or the log is closed.
+	SyncNever SyncPolicy = iota
+	// SyncAlways syncs every record before Append returns.
+	SyncAlways
+	// SyncEveryN syncs once every Segment.SyncEvery appended records.
+	SyncEveryN
+	// SyncOnInterval syncs from a background goroutine every Segment.SyncInterval.
+	SyncOnInterval
+)
+
+// Codec is the compression applied to records in the store.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecSnappy
+	CodecZstd
+)
+
+/*
+StreamLayer multiplexes the Raft connections of every partition's group on one
+listener. Connections for partition 0's group start with the RaftRPC byte, which
+the agent uses to tell Raft connections apart from gRPC ones, as every Raft
+connection did before topics had partitions, so servers from before then can
+still talk to the ones after during a rolling upgrade. Connections for the other
+partitions' groups start with the PartitionRaftRPC byte followed by the number
+of the partition.
+*/
 type StreamLayer struct {
 	listener        net.Listener
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
+
+	mu         sync.Mutex
+	partitions map[uint32]*partitionStreamLayer
+	accepting  sync.Once
+	// done is closed once the listener stops accepting connections, and err
+	// holds the reason.
+	done     chan struct{}
+	err      error
+	closing  sync.Once
+	closeErr error
 }
 
 func NewStreamLayer(listener net.Listener,
@@ -34,61 +118,195 @@ func NewStreamLayer(listener net.Listener,
 		listener:        listener,
 		serverTLSConfig: serverTLSConfig,
 		peerTLSConfig:   peerTLSConfig,
+		partitions:      make(map[uint32]*partitionStreamLayer),
+		done:            make(chan struct{}),
 	}
 }
 
-const RaftRPC = 1
+const (
+	RaftRPC          = 1
+	PartitionRaftRPC = 2
+)
+
+// partitionHeaderWidth is the width of the PartitionRaftRPC byte and the
+// partition number that start Raft connections for partitions other than 0.
+const partitionHeaderWidth = 1 + 4
+
+// handshakeTimeout bounds how long an accepted connection has to say which
+// partition it's for.
+const handshakeTimeout = 10 * time.Second
+
+// partition returns the stream layer of the given partition's Raft group.
+func (s *StreamLayer) partition(id uint32) *partitionStreamLayer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.partitions[id]; ok {
+		return p
+	}
+	p := &partitionStreamLayer{
+		StreamLayer: s,
+		id:          id,
+		conns:       make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+	s.partitions[id] = p
+	return p
+}
 
-// Dial makes outgoing connections to other servers in the Raft cluster.
-// When connect to a server, we write the RaftRPC byte to identify the
-// connection type, so we can multiplex Raft on the same port as our Log
-// gRPC requests.
-func (s StreamLayer) Dial(address raft.ServerAddress,
+// Dial connects to partition 0's group on the given server.
+func (s *StreamLayer) Dial(address raft.ServerAddress,
 	timeout time.Duration) (net.Conn, error) {
-	dialer := &net.Dialer{Timeout: timeout}
-	var conn, err = dialer.Dial("tcp", string(address))
-	if err != nil {
-		return nil, err
+	return s.partition(0).Dial(address, timeout)
+}
+
+// Accept accepts connections for partition 0's group.
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	return s.partition(0).Accept()
+}
+
+// Close closes the listener, which stops every partition's group from
+// accepting connections.
+func (s *StreamLayer) Close() error {
+	s.closing.Do(func() {
+		s.closeErr = s.listener.Close()
+	})
+	return s.closeErr
+}
+
+// Addr returns the listener’s address
+func (s *StreamLayer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// accept accepts connections until the listener is closed and hands each one
+// to its partition's group.
+func (s *StreamLayer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.err = err
+			close(s.done)
+			return
+		}
+		go s.route(conn)
 	}
-	_, err = conn.Write([]byte{byte(RaftRPC)})
-	if err != nil {
-		return nil, err
+}
+
+// route reads which partition the connection is for and passes it on to that
+// partition's group, creating a server-side TLS connection first. Connections
+// that aren't Raft connections or are for a partition we don't have are closed.
+func (s *StreamLayer) route(conn net.Conn) {
+	b := make([]byte, partitionHeaderWidth)
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		conn.Close()
+		return
 	}
-	if s.peerTLSConfig != nil {
-		// making a TLS client-side connection
-		return tls.Client(conn, s.peerTLSConfig), nil
+	var id uint32
+	switch b[0] {
+	case RaftRPC:
+	case PartitionRaftRPC:
+		if _, err := io.ReadFull(conn, b[1:]); err != nil {
+			conn.Close()
+			return
+		}
+		id = enc.Uint32(b[1:])
+	default:
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	s.mu.Lock()
+	p, ok := s.partitions[id]
+	s.mu.Unlock()
+	if !ok {
+		conn.Close()
+		return
+	}
+	if s.serverTLSConfig != nil {
+		conn = tls.Server(conn, s.serverTLSConfig)
+	}
+	select {
+	case p.conns <- conn:
+	case <-p.closed:
+		conn.Close()
 	}
-	return conn, nil
 }
 
-// Accept is the mirror of Dial. We accept the incoming connection and read the
-// byte that identifies the connection and then create a server-side TLS connection
-func (s StreamLayer) Accept() (net.Conn, error) {
-	// listener.Accept() waits for and returns the next connection to the listener.
-	conn, err := s.listener.Accept()
+// partitionStreamLayer is the raft.StreamLayer of one partition's group.
+type partitionStreamLayer struct {
+	*StreamLayer
+	id      uint32
+	conns   chan net.Conn
+	closed  chan struct{}
+	closing sync.Once
+}
+
+var _ raft.StreamLayer = (*partitionStreamLayer)(nil)
+
+// Dial makes outgoing connections to other servers in the partition's Raft
+// group. When connect to a server, we write the RaftRPC byte to identify the
+// connection type, so we can multiplex Raft on the same port as our Log gRPC
+// requests, or for partitions other than 0 the PartitionRaftRPC byte and the
+// partition number so the server can pass the connection to the partition's
+// group.
+func (p *partitionStreamLayer) Dial(address raft.ServerAddress,
+	timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn, err = dialer.Dial("tcp", string(address))
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
+	b := []byte{RaftRPC}
+	if p.id != 0 {
+		b = make([]byte, partitionHeaderWidth)
+		b[0] = PartitionRaftRPC
+		enc.PutUint32(b[1:], p.id)
+	}
+	_, err = conn.Write(b)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	if bytes.Compare([]byte{byte(RaftRPC)}, b) != 0 {
-		return nil, fmt.Errorf("not a raft rpc")
-	}
-	if s.serverTLSConfig != nil {
-		return tls.Server(conn, s.serverTLSConfig), nil
+	if p.peerTLSConfig != nil {
+		// making a TLS client-side connection, verified against the host
+		// dialed unless the config names the server
+		tlsConfig := p.peerTLSConfig
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(string(address))
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host
+		}
+		return tls.Client(conn, tlsConfig), nil
 	}
 	return conn, nil
 }
 
-// Close closes the listener
-func (s StreamLayer) Close() error {
-	return s.listener.Close()
+// Accept is the mirror of Dial. It returns the next connection the listener
+// accepted for this partition's group.
+func (p *partitionStreamLayer) Accept() (net.Conn, error) {
+	p.accepting.Do(func() {
+		go p.StreamLayer.accept()
+	})
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case <-p.closed:
+		return nil, fmt.Errorf("stream layer of partition %d is closed", p.id)
+	case <-p.done:
+		return nil, p.err
+	}
 }
 
-// Addr returns the listener’s address
-func (s StreamLayer) Addr() net.Addr {
-	return s.listener.Addr()
+// Close stops the partition's group from accepting connections. The listener
+// is shared by every group, so it stays open until the StreamLayer is closed.
+func (p *partitionStreamLayer) Close() error {
+	p.closing.Do(func() {
+		close(p.closed)
+	})
+	return nil
 }
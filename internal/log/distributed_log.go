@@ -2,6 +2,7 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	api "github.com/anshulsood11/loghouse/api/v1"
 	"github.com/hashicorp/raft"
@@ -12,46 +13,67 @@ import (
 	"time"
 )
 
+/*
+DistributedLog replicates the partitions of every topic. Each partition has its
+own Raft group, made of every server in the cluster, so that each group can
+have its leader on a different server and writes to different partitions don't
+all go through one leader. The groups share the server's StreamLayer.
+*/
 type DistributedLog struct {
-	config Config
-	log    *Log
-	raft   *raft.Raft
+	config     Config
+	partitions Partitions
+	// rafts holds the Raft group of each partition.
+	rafts []*raft.Raft
+	// shutdown stops the goroutines watching the groups' leadership.
+	shutdown chan struct{}
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
-	l := &DistributedLog{config: config}
+	l := &DistributedLog{config: config, shutdown: make(chan struct{})}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
 	}
-	if err := l.setupRaft(dataDir); err != nil {
-		return nil, err
+	for p := range l.partitions {
+		if err := l.setupRaft(dataDir, uint32(p)); err != nil {
+			return nil, err
+		}
+	}
+	for p := range l.rafts {
+		go l.watchLeadership(uint32(p))
 	}
 	return l, nil
 }
 
 /*
-setupLog(dataDir string) creates the log for this server, where this server will store
-the user’s records.
+setupLog(dataDir string) creates the partitions for this server, where this server
+will store the user’s records. Partition 0's default topic log is in dataDir/log, as
+the server's only log was before topics existed.
 */
 func (l *DistributedLog) setupLog(dataDir string) error {
-	logDir := filepath.Join(dataDir, "log")
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return err
-	}
 	var err error
-	l.log, err = NewLog(logDir, l.config)
+	l.partitions, err = NewPartitions(dataDir, l.config)
 	return err
 }
 
-func (l *DistributedLog) setupRaft(dataDir string) error {
+// setupRaft sets up the Raft group of partition p, which keeps its Raft data
+// next to the partition's topics.
+func (l *DistributedLog) setupRaft(dataDir string, p uint32) error {
+	dataDir = partitionDir(dataDir, p)
 	// Finite-state machine that applies the commands given
-	fsm := &fsm{log: l.log}
+	fsm := &fsm{partitions: l.partitions, partition: p}
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
+	// Raft decides which of its entries it no longer needs and deletes them
+	// through DeleteRange, so retention and compaction only apply to the user's
+	// log. Raft's entries have no keys and need every offset anyway.
+	logConfig.Retention.MaxBytes = 0
+	logConfig.Retention.MaxSegmentAge = 0
+	logConfig.Retention.MaxRecords = 0
+	logConfig.Compaction.Enabled = false
 	// Log Store where Raft stores the given commands. Using our own log implementation.
 	// Initial Offset is set to 1 as it is required by Raft.
 	logStore, err := newLogStore(logDir, logConfig)
@@ -81,7 +103,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	timeout := 10 * time.Second
 	// Raft uses transport to communicate with other nodes
 	transport := raft.NewNetworkTransport(
-		l.config.Raft.StreamLayer,
+		l.config.Raft.StreamLayer.partition(p),
 		maxPool,
 		timeout,
 		os.Stderr,
@@ -100,7 +122,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if l.config.Raft.CommitTimeout != 0 {
 		config.CommitTimeout = l.config.Raft.CommitTimeout
 	}
-	l.raft, err = raft.NewRaft(
+	r, err := raft.NewRaft(
 		config,
 		fsm,
 		logStore,
@@ -111,6 +133,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
+	l.rafts = append(l.rafts, r)
 	hasState, err := raft.HasExistingState(
 		logStore,
 		stableStore,
@@ -128,15 +151,33 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 				Address: transport.LocalAddr(),
 			}},
 		}
-		err = l.raft.BootstrapCluster(config).Error()
+		err = r.BootstrapCluster(config).Error()
 	}
 	return err
 }
 
-func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+func (l *DistributedLog) Append(topic string, partition uint32, record *api.Record) (
+	uint64, error) {
+	// Appends to a missing topic would fail on every server, so we fail them
+	// before they take up a Raft entry.
+	_, generation, err := l.partitions.topic(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	// The leader stamps the record before replicating it so that every server
+	// indexes it under the same time.
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 	res, err := l.apply(
+		partition,
 		AppendRequestType,
-		&api.ProduceRequest{Record: record},
+		&api.ProduceRequest{
+			Record:          record,
+			Topic:           topic,
+			Partition:       partition,
+			TopicGeneration: generation,
+		},
 	)
 	if err != nil {
 		return 0, err
@@ -144,8 +185,39 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
-// This must be run on the leader else it will fail
-func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+// AppendBatch replicates the records as a single Raft entry and returns the
+// offset of the first one; the others follow it.
+func (l *DistributedLog) AppendBatch(topic string, partition uint32,
+	records []*api.Record) (uint64, error) {
+	_, generation, err := l.partitions.topic(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+	}
+	res, err := l.apply(
+		partition,
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{
+			Records:         records,
+			Topic:           topic,
+			Partition:       partition,
+			TopicGeneration: generation,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceBatchResponse).FirstOffset, nil
+}
+
+// apply replicates the request through the partition's Raft group. This must be
+// run on the group's leader else it will fail
+func (l *DistributedLog) apply(partition uint32, reqType RequestType, req proto.Message) (
 	interface{},
 	error,
 ) {
@@ -163,9 +235,21 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 		return nil, err
 	}
 	timeout := 10 * time.Second
-	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	r := l.rafts[partition]
+	future := r.Apply(buf.Bytes(), timeout)
+	for deadline := time.Now().Add(timeout); future.Error() ==
+		raft.ErrLeadershipTransferInProgress && time.Now().Before(deadline); {
+		// the leader rejects writes while it hands leadership over, so the
+		// write waits to see whether it's still the leader afterwards
+		time.Sleep(10 * time.Millisecond)
+		future = r.Apply(buf.Bytes(), timeout)
+	}
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipTransferInProgress {
+			// the write wasn't applied, so it can be sent to the leader
+			return nil, api.ErrNotLeader{Partition: partition}
+		}
+		return nil, err
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
@@ -174,21 +258,188 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	return res, nil
 }
 
-func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	return l.log.Read(offset)
+/*
+VerifyLeader confirms that this server is still the partition's leader and has
+applied every write committed before the call, so that reads that follow see
+them. The barrier that waits for the writes goes through the group's log like
+a write does, so these reads cost about as much as a write.
+*/
+func (l *DistributedLog) VerifyLeader(partition uint32) error {
+	if partition >= l.PartitionCount() {
+		return api.ErrPartitionNotFound{Partition: partition}
+	}
+	r := l.rafts[partition]
+	err := r.VerifyLeader().Error()
+	if err == nil {
+		err = r.Barrier(10 * time.Second).Error()
+	}
+	return notLeader(partition, err)
 }
 
-// Join adds the server to the Raft cluster. Every server is added as a voter.
-// Servers can be added as a non-voters as well which are useful to replicate
-// the state to multiple servers to serve read only eventually consistent state.
-// Adding more voter servers makes replications and elections slower because
-// the leader has more servers to communicate with to reach a majority. This must
-// be run on the leader, or it will fail
-func (l *DistributedLog) Join(id, addr string) error {
-	if leader := l.raft.VerifyLeader(); leader.Error() != nil {
-		return nil
-	}
-	configFuture := l.raft.GetConfiguration()
+func (l *DistributedLog) Read(topic string, partition uint32, offset uint64) (
+	*api.Record, error) {
+	return l.partitions.Read(topic, partition, offset)
+}
+
+// WaitForOffset blocks until this server's copy of the partition has a record
+// at offset off or later, or ctx is done. Followers get the record once they've
+// applied it.
+func (l *DistributedLog) WaitForOffset(ctx context.Context, topic string,
+	partition uint32, off uint64) error {
+	return l.partitions.WaitForOffset(ctx, topic, partition, off)
+}
+
+// ReadRange reads up to maxRecords records or maxBytes bytes of records from
+// this server's copy of the partition, starting at offset from.
+func (l *DistributedLog) ReadRange(topic string, partition uint32,
+	from, maxRecords, maxBytes uint64) ([]*api.Record, error) {
+	return l.partitions.ReadRange(topic, partition, from, maxRecords, maxBytes)
+}
+
+// OffsetForTime returns the first offset appended at or after the given Unix
+// time in nanoseconds in this server's copy of the partition.
+func (l *DistributedLog) OffsetForTime(topic string, partition uint32,
+	timestamp int64) (uint64, error) {
+	return l.partitions.OffsetForTime(topic, partition, timestamp)
+}
+
+// CommitOffset replicates the offset the group has consumed the topic's
+// partition up to. This must be run on the partition's leader.
+func (l *DistributedLog) CommitOffset(group, topic string, partition uint32,
+	offset uint64) error {
+	_, generation, err := l.partitions.topic(topic, partition)
+	if err != nil {
+		return err
+	}
+	_, err = l.apply(partition, CommitOffsetRequestType, &api.CommitOffsetRequest{
+		Group:           group,
+		Topic:           topic,
+		Partition:       partition,
+		Offset:          offset,
+		TopicGeneration: generation,
+	})
+	return err
+}
+
+// FetchOffset returns the offset the group last committed for the topic's
+// partition in this server's copy of the partition, and whether it has
+// committed one.
+func (l *DistributedLog) FetchOffset(group, topic string, partition uint32) (
+	uint64, bool, error) {
+	return l.partitions.FetchOffset(group, topic, partition)
+}
+
+// CreateTopic creates a topic on every server. Topics are created through
+// partition 0's group, so this must be run on its leader.
+func (l *DistributedLog) CreateTopic(name string) error {
+	_, err := l.apply(0, CreateTopicRequestType, &api.CreateTopicRequest{Name: name})
+	return err
+}
+
+// DeleteTopic deletes a topic and its records on every server. This must be
+// run on the leader of partition 0's group.
+func (l *DistributedLog) DeleteTopic(name string) error {
+	_, err := l.apply(0, DeleteTopicRequestType, &api.DeleteTopicRequest{Name: name})
+	return err
+}
+
+// ListTopics lists the topics this server knows about.
+func (l *DistributedLog) ListTopics() ([]string, error) {
+	return l.partitions.ListTopics()
+}
+
+// PartitionCount returns the number of partitions every topic is split into.
+func (l *DistributedLog) PartitionCount() uint32 {
+	return l.partitions.PartitionCount()
+}
+
+// LeaderAddr returns the address of the partition's leader, or the empty
+// string when this server is its leader.
+func (l *DistributedLog) LeaderAddr(partition uint32) (string, error) {
+	if partition >= l.PartitionCount() {
+		return "", api.ErrPartitionNotFound{Partition: partition}
+	}
+	r := l.rafts[partition]
+	if r.State() == raft.Leader {
+		return "", nil
+	}
+	addr, _ := r.LeaderWithID()
+	if addr == "" {
+		return "", api.ErrNoLeader{Partition: partition}
+	}
+	return string(addr), nil
+}
+
+// Join adds the server to the Raft cluster, as a voter or a nonvoter.
+// Nonvoters are useful to replicate the state to multiple servers to serve read
+// only eventually consistent state. Adding more voter servers makes replications
+// and elections slower because the leader has more servers to communicate with
+// to reach a majority. The server is added to the groups this server is the
+// leader of; the other groups' leaders add it to theirs.
+func (l *DistributedLog) Join(id, addr string, voter bool) error {
+	for p, r := range l.rafts {
+		if leader := r.VerifyLeader(); leader.Error() != nil {
+			continue
+		}
+		if err := join(r, id, addr, voter); err == raft.ErrLeadershipTransferInProgress {
+			// the group's next leader adds the server when it takes over
+			continue
+		} else if err != nil {
+			return err
+		}
+		l.balanceLeader(uint32(p))
+	}
+	return nil
+}
+
+/*
+watchLeadership catches partition p's group up with the cluster when this
+server becomes its leader. Servers join and leave each group through the
+group's leader, so a server that joined while leadership was moving may have
+been left out of the group; partition 0's group has every server, so the new
+leader adds the ones it's missing. Leadership is only balanced again when
+servers were missing, so that leadership handed over on purpose stays put.
+*/
+func (l *DistributedLog) watchLeadership(p uint32) {
+	r := l.rafts[p]
+	for {
+		select {
+		case isLeader := <-r.LeaderCh():
+			if !isLeader || p == 0 {
+				continue
+			}
+			future := l.rafts[0].GetConfiguration()
+			if future.Error() != nil {
+				continue
+			}
+			before := groupSize(r)
+			for _, server := range future.Configuration().Servers {
+				_ = join(r, string(server.ID), string(server.Address),
+					server.Suffrage != raft.Nonvoter)
+			}
+			if groupSize(r) > before {
+				l.balanceLeader(p)
+			}
+		case <-l.shutdown:
+			return
+		}
+	}
+}
+
+// groupSize returns the number of servers in the group, or 0 if its
+// configuration can't be read.
+func groupSize(r *raft.Raft) int {
+	future := r.GetConfiguration()
+	if future.Error() != nil {
+		return 0
+	}
+	return len(future.Configuration().Servers)
+}
+
+// join adds the server to the group, or changes its suffrage when it's already
+// in the group.
+func join(r *raft.Raft, id, addr string, voter bool) error {
+	configFuture := r.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
 	}
@@ -197,35 +448,87 @@ func (l *DistributedLog) Join(id, addr string) error {
 
 	for _, server := range configFuture.Configuration().Servers {
 		if server.ID == joinedServerID && server.Address == joinedServerAddr {
-			// server has already joined
-			return nil
+			if (server.Suffrage != raft.Nonvoter) == voter {
+				// server has already joined
+				return nil
+			}
+			if !voter {
+				return r.DemoteVoter(joinedServerID, 0, 0).Error()
+			}
+			// adding a nonvoter as a voter promotes it
+			break
 		}
 		if server.ID == joinedServerID || server.Address == joinedServerAddr {
 			// remove any existing server with serverID and address combination not matching
-			removeFuture := l.raft.RemoveServer(joinedServerID, 0, 0)
+			removeFuture := r.RemoveServer(joinedServerID, 0, 0)
 			if err := removeFuture.Error(); err != nil {
 				return err
 			}
 		}
 	}
-	addFuture := l.raft.AddVoter(joinedServerID, joinedServerAddr, 0, 0)
+	addFuture := r.AddNonvoter(joinedServerID, joinedServerAddr, 0, 0)
+	if voter {
+		addFuture = r.AddVoter(joinedServerID, joinedServerAddr, 0, 0)
+	}
 	if err := addFuture.Error(); err != nil {
 		return err
 	}
 	return nil
 }
 
+/*
+balanceLeader spreads the groups' leaders across servers. Partition p's group
+prefers the (p mod n)-th of its n voters as its leader, in the order they
+joined, and its leader hands leadership over to that server in the background.
+Nonvoters can't lead.
+With a single partition there's nothing to spread, so the first server keeps
+leading.
+*/
+func (l *DistributedLog) balanceLeader(p uint32) {
+	if len(l.rafts) < 2 {
+		return
+	}
+	r := l.rafts[p]
+	future := r.GetConfiguration()
+	if future.Error() != nil {
+		return
+	}
+	var voters []raft.Server
+	for _, server := range future.Configuration().Servers {
+		if server.Suffrage != raft.Nonvoter {
+			voters = append(voters, server)
+		}
+	}
+	if len(voters) == 0 {
+		return
+	}
+	preferred := voters[int(p)%len(voters)]
+	if preferred.ID == l.config.Raft.LocalID {
+		return
+	}
+	go func() {
+		// the transfer fails if the preferred server can't catch up in time, in
+		// which case this server stays the leader
+		_ = r.LeadershipTransferToServer(preferred.ID, preferred.Address).Error()
+	}()
+}
+
 // Leave removes the server from the cluster. Removing the leader will
 // trigger a new election.
 func (l *DistributedLog) Leave(id string) error {
-	if leader := l.raft.VerifyLeader(); leader.Error() != nil {
-		return nil
+	for _, r := range l.rafts {
+		if leader := r.VerifyLeader(); leader.Error() != nil {
+			continue
+		}
+		removeFuture := r.RemoveServer(raft.ServerID(id), 0, 0)
+		if err := removeFuture.Error(); err != nil {
+			return err
+		}
 	}
-	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
-	return removeFuture.Error()
+	return nil
 }
 
-// WaitForLeader blocks until the cluster has elected a leader or times out.
+// WaitForLeader blocks until every group has elected a leader or times out.
 // It’s useful when writing tests
 func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	timeoutCh := time.After(timeout)
@@ -236,34 +539,112 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 		case <-timeoutCh:
 			return fmt.Errorf("timed out")
 		case <-ticker.C:
-			if _, currLeaderID := l.raft.LeaderWithID(); currLeaderID != "" {
+			if l.hasLeaders() {
 				return nil
 			}
 		}
 	}
 }
 
+func (l *DistributedLog) hasLeaders() bool {
+	for _, r := range l.rafts {
+		if _, currLeaderID := r.LeaderWithID(); currLeaderID == "" {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+DrainLeadership hands the leadership of the groups this server leads over to
+their most up to date voters, so that the cluster doesn't sit without a leader
+until an election timeout when the server shuts down. Writes the server gets
+from then on fail with api.ErrNotLeader. It returns once the server has heard
+from each group's new leader, so that those writes can be forwarded to it, or
+fails if it hasn't within the timeout. Groups without another voter stay with
+the server.
+*/
+func (l *DistributedLog) DrainLeadership() error {
+	for p, r := range l.rafts {
+		if r.State() != raft.Leader {
+			continue
+		}
+		future := r.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return err
+		}
+		voters := 0
+		for _, server := range future.Configuration().Servers {
+			if server.Suffrage == raft.Voter {
+				voters++
+			}
+		}
+		if voters < 2 {
+			continue
+		}
+		err := notLeader(uint32(p), r.LeadershipTransfer().Error())
+		if _, ok := err.(api.ErrNotLeader); !ok && err != nil {
+			return err
+		}
+		// the leadership moved on, whether handed over or by itself, but the
+		// server only learns who has it from the new leader's first heartbeat
+		if err = l.waitForNewLeader(uint32(p), 10*time.Second); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForNewLeader waits until the partition's group has a leader other than
+// this server.
+func (l *DistributedLog) waitForNewLeader(partition uint32, timeout time.Duration) error {
+	r := l.rafts[partition]
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); {
+		if _, id := r.LeaderWithID(); id != "" && id != l.config.Raft.LocalID {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for partition %d's new leader", partition)
+}
+
 func (l *DistributedLog) Close() error {
-	f := l.raft.Shutdown()
-	if err := f.Error(); err != nil {
-		return err
+	close(l.shutdown)
+	for _, r := range l.rafts {
+		f := r.Shutdown()
+		if err := f.Error(); err != nil {
+			return err
+		}
 	}
-	return l.log.Close()
+	// The groups share the listener, so closing their transports leaves it open.
+	// It may already be closed along with the server's other listeners, as Raft
+	// used to find it when it closed its transport, so the error is ignored.
+	_ = l.config.Raft.StreamLayer.Close()
+	return l.partitions.Close()
 }
 
+// GetServers returns the servers in the cluster. IsLeader is set on partition
+// 0's leader, Leads lists the partitions each server is the leader of, and
+// Nonvoter is set on the read replicas.
 func (l *DistributedLog) GetServers() ([]*api.Server, error) {
-	future := l.raft.GetConfiguration()
+	future := l.rafts[0].GetConfiguration()
 	if err := future.Error(); err != nil {
 		return nil, err
 	}
 	var servers []*api.Server
-	currLeaderAddress, _ := l.raft.LeaderWithID()
 	for _, server := range future.Configuration().Servers {
-		servers = append(servers, &api.Server{
+		s := &api.Server{
 			Id:       string(server.ID),
 			RpcAddr:  string(server.Address),
-			IsLeader: currLeaderAddress == server.Address,
-		})
+			Nonvoter: server.Suffrage == raft.Nonvoter,
+		}
+		for p, r := range l.rafts {
+			if currLeaderAddress, _ := r.LeaderWithID(); currLeaderAddress == server.Address {
+				s.Leads = append(s.Leads, uint32(p))
+			}
+		}
+		s.IsLeader = len(s.Leads) > 0 && s.Leads[0] == 0
+		servers = append(servers, s)
 	}
 	return servers, nil
 }
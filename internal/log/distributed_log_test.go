@@ -6,6 +6,7 @@ import (
 	"github.com/anshulsood11/loghouse/internal/test_util"
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -43,7 +44,7 @@ func TestMultipleNodes(t *testing.T) {
 		node, err := NewDistributedLog(dataDir, config)
 		require.NoError(t, err)
 		if i != 0 {
-			err = nodes[0].Join(strconv.Itoa(i), listener.Addr().String())
+			err = nodes[0].Join(strconv.Itoa(i), listener.Addr().String(), true)
 			require.NoError(t, err)
 		} else {
 			err = node.WaitForLeader(3 * time.Second)
@@ -60,13 +61,13 @@ func TestMultipleNodes(t *testing.T) {
 	// Appending some records to our leader server and checking that Raft
 	// replicates the records to its followers.
 	for _, record := range records {
-		originalOffset, err := nodes[0].Append(record)
+		originalOffset, err := nodes[0].Append(DefaultTopic, 0, record)
 		require.NoError(t, err)
 
 		require.Eventually(t, func() bool {
 			// check whether the record is replicated to each node
 			for j := 0; j < nodeCount; j++ {
-				replicatedRecord, err := nodes[j].Read(originalOffset)
+				replicatedRecord, err := nodes[j].Read(DefaultTopic, 0, originalOffset)
 				if err != nil {
 					return false
 				}
@@ -80,6 +81,60 @@ func TestMultipleNodes(t *testing.T) {
 			50*time.Millisecond)
 	}
 
+	// A batch is replicated as one entry and keeps its records in order.
+	batch := []*api.Record{
+		{Value: []byte("batch first")},
+		{Value: []byte("batch second")},
+	}
+	first, err := nodes[0].AppendBatch(DefaultTopic, 0, batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(records)), first)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			for i, want := range batch {
+				replicatedRecord, err := nodes[j].Read(DefaultTopic, 0, first+uint64(i))
+				if err != nil || string(replicatedRecord.Value) != string(want.Value) {
+					return false
+				}
+			}
+		}
+		return true
+	},
+		500*time.Millisecond,
+		50*time.Millisecond)
+
+	// topics are created on every server, and their records replicated
+	require.NoError(t, nodes[0].CreateTopic("orders"))
+	off, err := nodes[0].Append("orders", 0, &api.Record{Value: []byte("order")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			record, err := nodes[j].Read("orders", 0, off)
+			if err != nil {
+				return false
+			}
+			if string(record.Value) != "order" {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = nodes[0].Append("missing", 0, &api.Record{Value: []byte("lost")})
+	require.Equal(t, api.ErrTopicNotFound{Topic: "missing"}, err)
+
+	// committed offsets are replicated too
+	require.NoError(t, nodes[0].CommitOffset("billing", "orders", 0, off+1))
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			offset, committed, err := nodes[j].FetchOffset("billing", "orders", 0)
+			if err != nil || !committed || offset != off+1 {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
 	servers, err := nodes[0].GetServers()
 	require.NoError(t, err)
 	require.Equal(t, 3, len(servers))
@@ -100,19 +155,330 @@ func TestMultipleNodes(t *testing.T) {
 	require.True(t, servers[0].IsLeader)
 	require.False(t, servers[1].IsLeader)
 
-	off, err := nodes[0].Append(&api.Record{
+	off, err = nodes[0].Append(DefaultTopic, 0, &api.Record{
 		Value: []byte("third"),
 	})
 	require.NoError(t, err)
 
 	time.Sleep(50 * time.Millisecond)
 
-	record, err := nodes[1].Read(off)
+	record, err := nodes[1].Read(DefaultTopic, 0, off)
 	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
 	require.Nil(t, record)
 
-	record, err = nodes[2].Read(off)
+	record, err = nodes[2].Read(DefaultTopic, 0, off)
 	require.NoError(t, err)
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestPartitionedNodes(t *testing.T) {
+	var nodes []*DistributedLog
+	nodeCount := 3
+	ports := test_util.GetFreePorts(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "partitioned-log-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := Config{}
+		config.Partitions = 3
+		config.Raft.StreamLayer = NewStreamLayer(listener, nil, nil)
+		config.Raft.LocalID = raft.ServerID(strconv.Itoa(i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		node, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer node.Close()
+		if i == 0 {
+			require.NoError(t, node.WaitForLeader(3*time.Second))
+		}
+		// every server hears about the new server, and each adds it to the
+		// groups it's the leader of
+		for _, n := range nodes {
+			require.NoError(t, n.Join(strconv.Itoa(i), listener.Addr().String(), true))
+		}
+		nodes = append(nodes, node)
+	}
+
+	// partition p's leadership moves to the p-th server
+	leaders := func() map[uint32]string {
+		leaders := make(map[uint32]string)
+		servers, err := nodes[0].GetServers()
+		require.NoError(t, err)
+		for _, server := range servers {
+			for _, p := range server.Leads {
+				leaders[p] = server.Id
+			}
+		}
+		return leaders
+	}
+	require.Eventually(t, func() bool {
+		return len(leaders()) == 3 &&
+			leaders()[0] == "0" && leaders()[1] == "1" && leaders()[2] == "2"
+	}, 5*time.Second, 50*time.Millisecond)
+	servers, err := nodes[0].GetServers()
+	require.NoError(t, err)
+	require.True(t, servers[0].IsLeader)
+	require.False(t, servers[1].IsLeader)
+	// followers know where to forward writes to each partition
+	for p := uint32(0); p < 3; p++ {
+		for i, node := range nodes {
+			addr, err := node.LeaderAddr(p)
+			require.NoError(t, err)
+			if uint32(i) == p {
+				require.Equal(t, "", addr)
+			} else {
+				require.Equal(t, servers[p].RpcAddr, addr)
+			}
+		}
+	}
+	_, err = nodes[0].LeaderAddr(3)
+	require.Equal(t, api.ErrPartitionNotFound{Partition: 3}, err)
+	// only the partition's leader serves leader-verified reads
+	require.NoError(t, nodes[1].VerifyLeader(1))
+	require.Equal(t, api.ErrNotLeader{Partition: 1}, nodes[0].VerifyLeader(1))
+
+	require.NoError(t, nodes[0].CreateTopic("orders"))
+	for p := uint32(0); p < 3; p++ {
+		// only the partition's leader can append to it
+		if p != 0 {
+			_, err := nodes[0].Append("orders", p, &api.Record{Value: []byte("lost")})
+			require.Error(t, err)
+		}
+		off, err := nodes[p].Append("orders", p, &api.Record{
+			Value: []byte(fmt.Sprintf("partition %d", p)),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			for p := uint32(0); p < 3; p++ {
+				record, err := node.Read("orders", p, 0)
+				if err != nil {
+					return false
+				}
+				if string(record.Value) != fmt.Sprintf("partition %d", p) {
+					return false
+				}
+			}
+		}
+		return true
+	}, time.Second, 50*time.Millisecond)
+
+	_, err = nodes[0].Read("orders", 3, 0)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 3}, err)
+
+	// offsets are committed through the partition's group too
+	err = nodes[0].CommitOffset("billing", "orders", 1, 1)
+	require.Equal(t, api.ErrNotLeader{Partition: 1}, err)
+	require.NoError(t, nodes[1].CommitOffset("billing", "orders", 1, 1))
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			offset, committed, err := node.FetchOffset("billing", "orders", 1)
+			if err != nil || !committed || offset != 1 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 50*time.Millisecond)
+}
+
+func TestReadReplicas(t *testing.T) {
+	var nodes []*DistributedLog
+	var addrs []string
+	nodeCount := 3
+	ports := test_util.GetFreePorts(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "read-replica-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := Config{}
+		config.Partitions = 2
+		config.Raft.StreamLayer = NewStreamLayer(listener, nil, nil)
+		config.Raft.LocalID = raft.ServerID(strconv.Itoa(i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		node, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer node.Close()
+		if i == 0 {
+			require.NoError(t, node.WaitForLeader(3*time.Second))
+		}
+		// the second server is a read replica
+		for _, n := range nodes {
+			require.NoError(t, n.Join(strconv.Itoa(i), listener.Addr().String(), i != 1))
+		}
+		nodes = append(nodes, node)
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	// leadership is spread across the voters only
+	leaders := func() map[uint32]string {
+		leaders := make(map[uint32]string)
+		servers, err := nodes[0].GetServers()
+		require.NoError(t, err)
+		for _, server := range servers {
+			for _, p := range server.Leads {
+				leaders[p] = server.Id
+			}
+		}
+		return leaders
+	}
+	require.Eventually(t, func() bool {
+		return len(leaders()) == 2 && leaders()[0] == "0" && leaders()[1] == "2"
+	}, 5*time.Second, 50*time.Millisecond)
+	nonvoters := func() map[string]bool {
+		nonvoters := make(map[string]bool)
+		servers, err := nodes[0].GetServers()
+		require.NoError(t, err)
+		for _, server := range servers {
+			nonvoters[server.Id] = server.Nonvoter
+		}
+		return nonvoters
+	}
+	require.Equal(t, map[string]bool{"0": false, "1": true, "2": false}, nonvoters())
+
+	// replicas get the records without voting on them
+	off, err := nodes[0].Append(DefaultTopic, 0, &api.Record{Value: []byte("replicated")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		record, err := nodes[1].Read(DefaultTopic, 0, off)
+		return err == nil && string(record.Value) == "replicated"
+	}, time.Second, 50*time.Millisecond)
+
+	// rejoining with another role changes the server's suffrage
+	for _, n := range nodes {
+		require.NoError(t, n.Join("1", addrs[1], true))
+	}
+	require.Eventually(t, func() bool {
+		return !nonvoters()["1"]
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if err := n.Join("1", addrs[1], false); err != nil {
+				return false
+			}
+		}
+		return nonvoters()["1"]
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestDrainLeadership(t *testing.T) {
+	var nodes []*DistributedLog
+	nodeCount := 3
+	ports := test_util.GetFreePorts(nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "drain-leadership-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := Config{}
+		config.Partitions = 2
+		config.Raft.StreamLayer = NewStreamLayer(listener, nil, nil)
+		config.Raft.LocalID = raft.ServerID(strconv.Itoa(i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		node, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer node.Close()
+		if i == 0 {
+			require.NoError(t, node.WaitForLeader(3*time.Second))
+			// a server that's the only voter keeps leading
+			require.NoError(t, node.DrainLeadership())
+			require.Equal(t, raft.Leader, node.rafts[0].State())
+		}
+		for _, n := range nodes {
+			require.NoError(t, n.Join(strconv.Itoa(i), listener.Addr().String(), true))
+		}
+		nodes = append(nodes, node)
+	}
+	leaders := func() map[uint32]string {
+		leaders := make(map[uint32]string)
+		servers, err := nodes[2].GetServers()
+		require.NoError(t, err)
+		for _, server := range servers {
+			for _, p := range server.Leads {
+				leaders[p] = server.Id
+			}
+		}
+		return leaders
+	}
+	require.Eventually(t, func() bool {
+		return len(leaders()) == 2 && leaders()[0] == "0" && leaders()[1] == "1"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the drained server leads nothing once it returns
+	require.NoError(t, nodes[0].DrainLeadership())
+	for _, r := range nodes[0].rafts {
+		require.NotEqual(t, raft.Leader, r.State())
+	}
+	require.Equal(t, "1", leaders()[1])
+	// and writes it gets can be sent to the new leader, which it already knows
+	_, err := nodes[0].Append(DefaultTopic, 0, &api.Record{Value: []byte("redirected")})
+	require.Equal(t, api.ErrNotLeader{Partition: 0}, err)
+	addr, err := nodes[0].LeaderAddr(0)
+	require.NoError(t, err)
+	require.NotEmpty(t, addr)
+}
+
+// Servers from before topics had partitions start every Raft connection with
+// the RaftRPC byte alone, which is partition 0's header.
+func TestStreamLayerHeaders(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	layer := NewStreamLayer(ln, nil, nil)
+	defer layer.Close()
+	for _, p := range []uint32{0, 3} {
+		go func(p uint32) {
+			var conn net.Conn
+			var err error
+			if p == 0 {
+				// an old server's connection
+				conn, err = net.Dial("tcp", ln.Addr().String())
+				if err == nil {
+					_, err = conn.Write([]byte{RaftRPC})
+				}
+			} else {
+				conn, err = layer.partition(p).Dial(raft.ServerAddress(ln.Addr().String()),
+					time.Second)
+			}
+			if err == nil {
+				_, _ = fmt.Fprintf(conn, "partition %d", p)
+			}
+		}(p)
+		conn, err := layer.partition(p).Accept()
+		require.NoError(t, err)
+		b := make([]byte, len("partition 0"))
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("partition %d", p), string(b))
+		require.NoError(t, conn.Close())
+	}
+}
@@ -1,15 +1,21 @@
 package log
 
 import (
-	"bytes"
 	api "github.com/anshulsood11/loghouse/api/v1"
 	"github.com/hashicorp/raft"
 	"google.golang.org/protobuf/proto"
 	"io"
 )
 
+/*
+fsm applies the commands of one partition's Raft group to that partition.
+Topics are created and deleted through partition 0's group, which changes every
+partition on the server. Writes carry the generation of the topic they're for,
+so that the other groups can tell whether the topic was deleted.
+*/
 type fsm struct {
-	log *Log
+	partitions Partitions
+	partition  uint32
 }
 
 var _ raft.FSM = (*fsm)(nil)
@@ -17,7 +23,13 @@ var _ raft.FSM = (*fsm)(nil)
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType      RequestType = 0
+	AppendBatchRequestType RequestType = 1
+	CreateTopicRequestType RequestType = 2
+	DeleteTopicRequestType RequestType = 3
+	// CommitOffsetRequestType commits a consumer group's offset. Offsets are
+	// committed through the group of the partition they're for.
+	CommitOffsetRequestType RequestType = 4
 )
 
 // Apply is invoked by Raft after committing a log entry.
@@ -27,6 +39,14 @@ func (f fsm) Apply(log *raft.Log) interface{} {
 	switch reqType {
 	case AppendRequestType:
 		return f.applyAppend(buf[1:])
+	case AppendBatchRequestType:
+		return f.applyAppendBatch(buf[1:])
+	case CreateTopicRequestType:
+		return f.applyCreateTopic(buf[1:], log.Index)
+	case DeleteTopicRequestType:
+		return f.applyDeleteTopic(buf[1:], log.Index)
+	case CommitOffsetRequestType:
+		return f.applyCommitOffset(buf[1:])
 	}
 	return nil
 }
@@ -37,53 +57,91 @@ func (f *fsm) applyAppend(b []byte) interface{} {
 	if err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
+	log, err := f.partitions.replicatedTopic(req.Topic, f.partition, req.TopicGeneration)
+	if err != nil {
+		return err
+	}
+	offset, err := log.Append(req.Record)
 	if err != nil {
 		return err
 	}
 	return &api.ProduceResponse{Offset: offset}
 }
 
+func (f *fsm) applyAppendBatch(b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	log, err := f.partitions.replicatedTopic(req.Topic, f.partition, req.TopicGeneration)
+	if err != nil {
+		return err
+	}
+	offset, err := log.AppendBatch(req.Records)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceBatchResponse{FirstOffset: offset}
+}
+
+// applyCreateTopic creates the topic, as the generation of the entry's index.
+func (f *fsm) applyCreateTopic(b []byte, index uint64) interface{} {
+	var req api.CreateTopicRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if err := f.partitions.createTopic(req.Name, index); err != nil {
+		return err
+	}
+	return &api.CreateTopicResponse{}
+}
+
+func (f *fsm) applyDeleteTopic(b []byte, index uint64) interface{} {
+	var req api.DeleteTopicRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if err := f.partitions.deleteTopic(req.Name, index); err != nil {
+		return err
+	}
+	return &api.DeleteTopicResponse{}
+}
+
+func (f *fsm) applyCommitOffset(b []byte) interface{} {
+	var req api.CommitOffsetRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	_, err := f.partitions.replicatedTopic(req.Topic, f.partition, req.TopicGeneration)
+	if err != nil {
+		return err
+	}
+	err = f.partitions[f.partition].CommitOffset(req.Group, req.Topic, req.Offset)
+	if err != nil {
+		return err
+	}
+	return &api.CommitOffsetResponse{}
+}
+
 // Snapshot returns an FSMSnapshot that represents a point-in-time snapshot of
 // the FSM’s state.
 func (f fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
-	return &snapshot{reader: r}, nil
+	s, err := newTopicsSnapshot(f.partitions[f.partition])
+	if err != nil {
+		return nil, err
+	}
+	s.partition = f.partition
+	return s, nil
 }
 
 // Restore is called by Raft to restore an FSM from a snapshot.
 func (f fsm) Restore(snapshot io.ReadCloser) error {
-	b := make([]byte, lenWidth)
-	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(snapshot, b)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, snapshot, size); err != nil {
-			return err
-		}
-		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
-			return err
-		}
-		// The FSM must discard existing state to make sure its state will match the
-		// leader’s replicated state, so we reset the log and configure its initial offset
-		// to the first record’s offset we read from the snapshot so the log’s offsets match.
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
-				return err
-			}
-		}
-		// Appending the records one-by-one to our new log
-		if _, err = f.log.Append(record); err != nil {
-			return err
-		}
-		buf.Reset()
+	if err := restoreTopics(f.partitions[f.partition], snapshot); err != nil {
+		return err
+	}
+	if f.partition == 0 {
+		return f.partitions.dropDeletedTopics()
 	}
 	return nil
 }
@@ -0,0 +1,89 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+A topic can be deleted and created again under the same name, and each time
+it's created it starts a new generation. A replicated topic's generation is the
+Raft index of the entry that created it in partition 0's group, so every server
+gives it the same one, and writes to the topic carry the generation they were
+made for: the other partitions' groups apply them independently of partition
+0's, and the generation lets them tell a write for a deleted topic from one for
+the topic created again. Topics that aren't replicated get the next version
+instead.
+
+The topics' version is the highest generation, or Raft index of a deletion,
+they have applied. Topics keeps both in memory and in <dir>/generations, which
+holds the version followed by an entry for each topic, made of its name
+prefixed by its length and its generation. Topics from before generations
+existed are generation 0.
+*/
+
+func (t *Topics) generationsPath() string {
+	return filepath.Join(t.Dir, "generations")
+}
+
+// loadGenerations reads the topics' generations and version from disk. A
+// missing file means every topic is generation 0.
+func (t *Topics) loadGenerations() error {
+	t.generations = make(map[string]uint64)
+	t.version = 0
+	f, err := os.Open(t.generationsPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if err = binary.Read(r, enc, &t.version); err != nil {
+		return unexpectedEOF(err)
+	}
+	for {
+		name, err := readString(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var generation uint64
+		if err = binary.Read(r, enc, &generation); err != nil {
+			return unexpectedEOF(err)
+		}
+		t.generations[name] = generation
+	}
+}
+
+// saveGenerations writes the generations and version to a new file that then
+// replaces the old one, as saveOffsets does. The caller must hold the lock.
+func (t *Topics) saveGenerations() error {
+	tmp := t.generationsPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_ = binary.Write(w, enc, t.version)
+	for _, name := range sortedKeys(t.generations) {
+		writeString(w, name)
+		_ = binary.Write(w, enc, t.generations[name])
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.generationsPath())
+}
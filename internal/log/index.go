@@ -4,6 +4,7 @@ import (
 	"github.com/tysonmote/gommap"
 	"io"
 	"os"
+	"sort"
 )
 
 var (
@@ -65,6 +66,15 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+/*
+Sync writes the memory-mapped entries back to the index file. Unlike Close, it
+leaves the file at its preallocated size; segment recovery trims it on restart
+if the index isn't closed cleanly.
+*/
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 /*
 Read takes in an offset and returns the associated record’s position in
 the store. The given offset is relative to the segment’s base offset; 0 is always
@@ -91,6 +101,36 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+/*
+Find returns the first entry whose relative offset is at least in. A segment
+that hasn't been compacted holds offset in at entry in, which we check first;
+otherwise compaction removed entries before it and we binary search the
+entries, whose offsets are always increasing.
+*/
+func (i *index) Find(in uint32) (out uint32, pos uint64, err error) {
+	return i.Read(i.search(in))
+}
+
+// search returns the number of the first entry whose relative offset is at
+// least in, or the number of entries if there's none.
+func (i *index) search(in uint32) int64 {
+	entries := i.entries()
+	if int64(in) < entries {
+		if out, _, err := i.Read(int64(in)); err == nil && out == in {
+			return int64(in)
+		}
+	}
+	return int64(sort.Search(int(entries), func(j int) bool {
+		off, _, _ := i.Read(int64(j))
+		return off >= in
+	}))
+}
+
+// entries returns the number of entries in the index.
+func (i *index) entries() int64 {
+	return int64(i.size / entWidth)
+}
+
 /*
 Write appends the given offset and position to the index.
 First, we validate that we have space to write the entry. If there’s space, we
@@ -0,0 +1,408 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/golang/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+/*
+The functions in this file look at a log's files without changing them, so they
+can be pointed at a stopped server's data directory, or a copy of it, to find
+out what's on disk. Unlike NewLog, they don't recover segments that weren't
+closed cleanly; they report what recovery would find instead.
+*/
+
+// LogDir is the directory holding the log of a topic's partition.
+type LogDir struct {
+	Partition uint32
+	Topic     string
+	// Raft is set for the log a partition's Raft group keeps its entries in,
+	// which belongs to no topic.
+	Raft bool
+	Dir  string
+}
+
+/*
+LogDirs returns the logs in a server's data directory, laid out the way
+Partitions and Topics lay them out, ordered by partition and then topic, with
+the default topic first. A DistributedLog's data directory also holds a Raft
+log for each partition, which comes after the partition's topics.
+*/
+func LogDirs(dataDir string) ([]LogDir, error) {
+	partitions, err := partitionsIn(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []LogDir
+	for _, p := range partitions {
+		topics := &Topics{Dir: partitionDir(dataDir, p)}
+		names, err := topics.names()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, name := range append([]string{DefaultTopic}, names...) {
+			dir := topics.topicDir(name)
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, LogDir{Partition: p, Topic: name, Dir: dir})
+		}
+		dir := filepath.Join(partitionDir(dataDir, p), "raft", "log")
+		if _, err := os.Stat(dir); err == nil {
+			dirs = append(dirs, LogDir{Partition: p, Raft: true, Dir: dir})
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+// partitionsIn returns the partitions in a server's data directory, in order.
+func partitionsIn(dataDir string) ([]uint32, error) {
+	partitions := []uint32{0}
+	files, err := ioutil.ReadDir(filepath.Join(dataDir, "partitions"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		p, err := strconv.ParseUint(file.Name(), 10, 32)
+		if err == nil && p > 0 && file.IsDir() {
+			partitions = append(partitions, uint32(p))
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i] < partitions[j]
+	})
+	return partitions, nil
+}
+
+// SegmentInfo describes a segment's files.
+type SegmentInfo struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// NextOffset is the offset after the segment's last record.
+	NextOffset uint64 `json:"next_offset"`
+	// Records is the number of entries in the segment's index.
+	Records      uint64 `json:"records"`
+	StoreBytes   uint64 `json:"store_bytes"`
+	IndexBytes   uint64 `json:"index_bytes"`
+	StoreVersion uint32 `json:"store_version"`
+}
+
+// InspectLog describes the segments of the log in dir, oldest first.
+func InspectLog(dir string) ([]SegmentInfo, error) {
+	var infos []SegmentInfo
+	err := eachSegment(dir, func(s *segment) error {
+		infos = append(infos, SegmentInfo{
+			BaseOffset:   s.baseOffset,
+			NextOffset:   segmentEnd(s),
+			Records:      usedEntries(s),
+			StoreBytes:   s.store.size,
+			IndexBytes:   s.index.size,
+			StoreVersion: s.store.version,
+		})
+		return nil
+	})
+	return infos, err
+}
+
+/*
+DumpLog calls fn with each record in the log in dir from offset from onwards,
+in order. It stops with api.ErrCorruptRecord at the first record that can't be
+read; VerifyLog finds all of them.
+*/
+func DumpLog(dir string, from uint64, fn func(*api.Record) error) error {
+	return eachSegment(dir, func(s *segment) error {
+		for i := uint64(0); i < usedEntries(s); i++ {
+			off, pos, err := s.index.Read(int64(i))
+			if err != nil {
+				return err
+			}
+			if s.baseOffset+uint64(off) < from {
+				continue
+			}
+			record, err := s.readAt(pos, s.baseOffset+uint64(off))
+			if err != nil {
+				return err
+			}
+			if err = fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// IssueKind is the kind of problem VerifyLog found.
+type IssueKind string
+
+const (
+	// IssueOffsetGap is a range of offsets with no records. Compaction removes
+	// records, so gaps are expected in compacted logs.
+	IssueOffsetGap IssueKind = "offset_gap"
+	// IssueOverlap is a segment that starts before the previous one ends.
+	IssueOverlap IssueKind = "overlapping_segments"
+	// IssueBadEntry is an index entry that's out of order, overlaps the previous
+	// record's frame or is cut short.
+	IssueBadEntry IssueKind = "bad_index_entry"
+	// IssueCorruptRecord is an index entry whose frame in the store is cut short,
+	// fails its checksum or doesn't hold the entry's record.
+	IssueCorruptRecord IssueKind = "corrupt_record"
+	// IssueUnindexedBytes is bytes between two records in the store that no
+	// index entry points at.
+	IssueUnindexedBytes IssueKind = "unindexed_bytes"
+	// IssueTrailingBytes is bytes in the store after the last indexed record,
+	// like a record torn by a crash or one whose index entry was never synced.
+	IssueTrailingBytes IssueKind = "trailing_bytes"
+	// IssuePreallocatedIndex is an index that still ends in the zeroed entries
+	// it was grown with because it wasn't closed cleanly. Recovery trims them.
+	IssuePreallocatedIndex IssueKind = "preallocated_index"
+)
+
+// Issue is a problem VerifyLog found in a segment.
+type Issue struct {
+	Kind IssueKind `json:"kind"`
+	// BaseOffset is the base offset of the segment the issue is in.
+	BaseOffset uint64 `json:"base_offset"`
+	// Offset is the offset of the record the issue is at, or the offset the
+	// record after it would have.
+	Offset uint64 `json:"offset"`
+	Detail string `json:"detail"`
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("segment %d, offset %d: %s: %s", i.BaseOffset, i.Offset, i.Kind, i.Detail)
+}
+
+// Corrupt returns whether the issue means records are, or may be, lost. Gaps
+// and preallocated indexes are left by compaction and unclean shutdowns.
+func (i Issue) Corrupt() bool {
+	return i.Kind != IssueOffsetGap && i.Kind != IssuePreallocatedIndex
+}
+
+/*
+VerifyLog checks that every index entry of the log in dir points at a whole
+frame in the store holding the entry's record, that the records follow each
+other in the store, and that nothing is left in the store after the last of
+them. It returns the issues it found, in order.
+*/
+func VerifyLog(dir string) ([]Issue, error) {
+	var issues []Issue
+	first, next := true, uint64(0)
+	err := eachSegment(dir, func(s *segment) error {
+		if !first && s.baseOffset > next {
+			issues = append(issues, Issue{IssueOffsetGap, s.baseOffset, next,
+				fmt.Sprintf("offsets %d to %d are missing before the segment",
+					next, s.baseOffset-1)})
+		} else if !first && s.baseOffset < next {
+			issues = append(issues, Issue{IssueOverlap, s.baseOffset, s.baseOffset,
+				fmt.Sprintf("the previous segment ends at offset %d", next-1)})
+		}
+		first = false
+		segmentIssues, err := verifySegment(s)
+		issues = append(issues, segmentIssues...)
+		if end := segmentEnd(s); end > next {
+			next = end
+		}
+		return err
+	})
+	return issues, err
+}
+
+// verifySegment returns the issues in the segment, as VerifyLog describes.
+func verifySegment(s *segment) ([]Issue, error) {
+	var issues []Issue
+	report := func(kind IssueKind, off uint64, format string, a ...interface{}) {
+		issues = append(issues, Issue{kind, s.baseOffset, off, fmt.Sprintf(format, a...)})
+	}
+	used := usedEntries(s)
+	// the preallocated size needn't be a whole number of entries, so a partial
+	// entry at the end is only a problem in an index that was closed cleanly
+	tail := s.index.size - used*entWidth
+	switch {
+	case tail >= entWidth, tail > 0 && allZero(s.index.mmap[used*entWidth:]):
+		report(IssuePreallocatedIndex, segmentEnd(s),
+			"%d bytes of zeroed entries after the last one", tail)
+	case tail > 0:
+		report(IssueBadEntry, segmentEnd(s),
+			"the index ends in a partial entry of %d bytes", tail)
+	}
+	end := s.store.dataStart()
+	if s.store.size < end {
+		report(IssueTrailingBytes, s.baseOffset,
+			"the store's %d bytes are less than its header", s.store.size)
+		return issues, nil
+	}
+	next := s.baseOffset
+	// lost is set when a frame is too damaged to tell where it ends
+	lost := false
+	for i := uint64(0); i < used; i++ {
+		rel, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return issues, err
+		}
+		off := s.baseOffset + uint64(rel)
+		if off < next {
+			report(IssueBadEntry, off, "entry %d comes after offset %d", i, next-1)
+			continue
+		}
+		if off > next {
+			report(IssueOffsetGap, next, "offsets %d to %d are missing", next, off-1)
+		}
+		next = off + 1
+		if lost {
+			end, lost = pos, false
+		}
+		if pos < end {
+			report(IssueBadEntry, off,
+				"the record at position %d overlaps the one before it, which ends at %d",
+				pos, end)
+		} else if pos > end {
+			report(IssueUnindexedBytes, off, "%d bytes at position %d", pos-end, end)
+		}
+		p, codec, err := s.store.Read(pos)
+		if errors.Is(err, errCorruptFrame) {
+			report(IssueCorruptRecord, off, "%v", err)
+			lost = true
+			continue
+		}
+		if err != nil {
+			return issues, err
+		}
+		if frameEnd := pos + frameOverhead(s.store.version) + uint64(len(p)); frameEnd > end {
+			end = frameEnd
+		}
+		if p, err = decompress(codec, p); err != nil {
+			report(IssueCorruptRecord, off, "%v", err)
+			continue
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			report(IssueCorruptRecord, off, "the frame at %d doesn't hold a record: %v", pos, err)
+			continue
+		}
+		if record.Offset != off {
+			report(IssueCorruptRecord, off, "the frame at %d holds offset %d", pos, record.Offset)
+		}
+	}
+	if !lost && end < s.store.size {
+		// count the records that made it to the store but not the index
+		whole := 0
+		for pos := end; pos < s.store.size; whole++ {
+			frameEnd, err := s.store.frameEnd(pos)
+			if err != nil {
+				break
+			}
+			pos = frameEnd
+		}
+		report(IssueTrailingBytes, next,
+			"%d bytes at position %d, holding %d whole unindexed records",
+			s.store.size-end, end, whole)
+	}
+	return issues, nil
+}
+
+// eachSegment opens each segment of the log in dir read-only, oldest first, and
+// calls fn with it.
+func eachSegment(dir string, fn func(*segment) error) error {
+	baseOffsets, err := segmentOffsets(dir)
+	if err != nil {
+		return err
+	}
+	for _, baseOffset := range baseOffsets {
+		s, err := openSegmentReadOnly(dir, baseOffset)
+		if err != nil {
+			return err
+		}
+		err = fn(s)
+		s.store.File.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+openSegmentReadOnly opens the store and index of a segment for reading. Instead
+of being memory-mapped, the index is read into memory whole, and neither file
+is recovered, grown or truncated. Only the store has to be closed.
+*/
+func openSegmentReadOnly(dir string, baseOffset uint64) (*segment, error) {
+	storeFile, err := os.Open(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := storeFile.Stat()
+	if err != nil {
+		storeFile.Close()
+		return nil, err
+	}
+	s := &segment{
+		baseOffset: baseOffset,
+		store: &store{
+			File:    storeFile,
+			size:    uint64(fi.Size()),
+			buf:     bufio.NewWriter(storeFile),
+			version: currentStoreVersion,
+		},
+	}
+	if s.store.size >= headerWidth {
+		if s.store.version, err = readStoreVersion(storeFile); err != nil {
+			storeFile.Close()
+			return nil, err
+		}
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")))
+	if err != nil && !os.IsNotExist(err) {
+		storeFile.Close()
+		return nil, err
+	}
+	s.index = &index{mmap: b, size: uint64(len(b))}
+	return s, nil
+}
+
+/*
+usedEntries returns the number of entries in the segment's index before the
+zeroed ones an index that wasn't closed cleanly ends in. Like recover, it relies
+on entry i holding relative offset i or a later one, which zeroed entries past
+the first don't.
+*/
+func usedEntries(s *segment) uint64 {
+	for i := uint64(s.index.entries()); i > 0; i-- {
+		off, pos, err := s.index.Read(int64(i - 1))
+		if err == nil && uint64(off) >= i-1 && pos >= s.store.dataStart() {
+			return i
+		}
+	}
+	return 0
+}
+
+// segmentEnd returns the offset after the last record in the segment's index.
+func segmentEnd(s *segment) uint64 {
+	used := usedEntries(s)
+	if used == 0 {
+		return s.baseOffset
+	}
+	off, _, _ := s.index.Read(int64(used - 1))
+	return s.baseOffset + uint64(off) + 1
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
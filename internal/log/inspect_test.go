@@ -0,0 +1,121 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "inspect-log-test")
+	defer os.RemoveAll(dir)
+	c := Config{Partitions: 2}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	ps, err := NewPartitions(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, ps.CreateTopic("events"))
+	for i := 0; i < 5; i++ {
+		_, err = ps.Append(DefaultTopic, 0, &api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = ps.Append("events", 1, &api.Record{Value: []byte("event")})
+	require.NoError(t, err)
+	require.NoError(t, ps.Close())
+
+	dirs, err := LogDirs(dir)
+	require.NoError(t, err)
+	require.Equal(t, []LogDir{
+		{Partition: 0, Topic: DefaultTopic, Dir: filepath.Join(dir, "log")},
+		{Partition: 0, Topic: "events", Dir: filepath.Join(dir, "topics", "events")},
+		{Partition: 1, Topic: DefaultTopic, Dir: filepath.Join(dir, "partitions", "1", "log")},
+		{Partition: 1, Topic: "events", Dir: filepath.Join(dir, "partitions", "1", "topics", "events")},
+	}, dirs)
+
+	infos, err := InspectLog(dirs[0].Dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(infos))
+	require.Equal(t, uint64(0), infos[0].BaseOffset)
+	require.Equal(t, uint64(3), infos[0].NextOffset)
+	require.Equal(t, uint64(3), infos[0].Records)
+	require.Equal(t, 3*entWidth, infos[0].IndexBytes)
+	require.Equal(t, currentStoreVersion, infos[0].StoreVersion)
+	require.Equal(t, uint64(3), infos[1].BaseOffset)
+	require.Equal(t, uint64(5), infos[1].NextOffset)
+
+	var offsets []uint64
+	require.NoError(t, DumpLog(dirs[0].Dir, 2, func(record *api.Record) error {
+		require.Equal(t, []byte("hello world"), record.Value)
+		offsets = append(offsets, record.Offset)
+		return nil
+	}))
+	require.Equal(t, []uint64{2, 3, 4}, offsets)
+
+	for _, d := range dirs {
+		issues, err := VerifyLog(d.Dir)
+		require.NoError(t, err)
+		require.Empty(t, issues, d.Dir)
+	}
+}
+
+func TestVerifyLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "verify-log-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Sync())
+	s := l.activeSegment
+	// a torn write leaves part of a record at the end of the store
+	_, err = s.store.File.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	// and a flipped bit breaks the second record
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+frameOverhead(s.store.version)))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 1}, int64(pos+frameOverhead(s.store.version)))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the log is never closed, so the index keeps its preallocated size
+	storeSize := s.store.size + 3
+	issues, err := VerifyLog(dir)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(issues), issues)
+	require.Equal(t, IssuePreallocatedIndex, issues[0].Kind)
+	require.False(t, issues[0].Corrupt())
+	require.Equal(t, IssueCorruptRecord, issues[1].Kind)
+	require.Equal(t, uint64(1), issues[1].Offset)
+	require.True(t, issues[1].Corrupt())
+	require.Equal(t, IssueTrailingBytes, issues[2].Kind)
+	require.Equal(t, uint64(3), issues[2].Offset)
+
+	// records before the broken one can be dumped
+	var offsets []uint64
+	err = DumpLog(dir, 0, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	require.Equal(t, api.ErrCorruptRecord{Offset: 1}, err)
+	require.Equal(t, []uint64{0}, offsets)
+
+	// and nothing is changed on disk
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(storeSize), fi.Size())
+	fi, err = os.Stat(s.index.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(c.Segment.MaxIndexBytes), fi.Size())
+	require.NoError(t, l.Close())
+}
@@ -1,7 +1,12 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	api "github.com/anshulsood11/loghouse/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 	"io"
 	"io/ioutil"
 	"os"
@@ -10,38 +15,122 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// errLogClosed is returned to readers waiting on a log that's closed.
+var errLogClosed = errors.New("log is closed")
+
 type Log struct {
 	mu            sync.RWMutex //https://medium.com/bootdotdev/golang-mutexes-what-is-rwmutex-for-5360ab082626
 	Dir           string       // directory is where we store the segments
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	syncMu        sync.Mutex // serializes syncs, which only hold mu for reading
+	unsynced      uint64     // records appended since the last sync, for SyncEveryN
+	// closing is closed to stop the background goroutines, like the flusher and
+	// the retention cleaner, and background waits for them to return
+	closing    chan struct{}
+	background sync.WaitGroup
+	// maintenance serializes the operations that remove or rewrite whole
+	// segments, so compaction can read closed segments without holding mu
+	maintenance sync.Mutex
+	// appended is closed and replaced whenever records are appended, to wake up
+	// the readers waiting for them in WaitForOffset
+	appended chan struct{}
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
+	l := &Log{
+		Dir:    dir,
+		Config: withDefaults(c),
+	}
+	return l, l.setup()
+}
+
+// withDefaults returns c with the defaults filled in for the settings it leaves
+// unset.
+func withDefaults(c Config) Config {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
 	}
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
-	l := &Log{
-		Dir:    dir,
-		Config: c,
+	if c.Segment.TimeIndexInterval == 0 {
+		c.Segment.TimeIndexInterval = 4096
 	}
-	return l, l.setup()
+	if c.Compaction.Enabled && c.Compaction.TombstoneRetention == 0 {
+		c.Compaction.TombstoneRetention = 24 * time.Hour
+	}
+	return c
 }
 
 func (l *Log) setup() error {
-	// Fetch the list of the segments on disk in the log's directory
-	files, err := ioutil.ReadDir(l.Dir)
+	if err := l.finishCompactions(); err != nil {
+		return err
+	}
+	baseOffsets, err := segmentOffsets(l.Dir)
 	if err != nil {
 		return err
 	}
+	for i := 0; i < len(baseOffsets); i++ {
+		if err = l.newSegment(baseOffsets[i]); err != nil {
+			return err
+		}
+	}
+	if l.segments == nil {
+		if err = l.newSegment(
+			l.Config.Segment.InitialOffset,
+		); err != nil {
+			return err
+		}
+	}
+	l.closing = make(chan struct{})
+	// the log may have been reset, so wake up anyone waiting on the old one
+	l.notifyAppended()
+	if l.Config.Segment.SyncPolicy == SyncOnInterval {
+		// flusher syncs the log every SyncInterval for the SyncOnInterval policy
+		l.runPeriodically(l.Config.Segment.SyncInterval, func() {
+			if err := l.Sync(); err != nil {
+				zap.L().Named("log").Error("failed to sync log", zap.Error(err))
+			}
+		})
+	}
+	if retentionEnabled(l.Config) {
+		// cleaner removes the segments that fall outside the retention limits
+		l.runPeriodically(l.Config.Retention.CheckInterval, func() {
+			if _, err := l.EnforceRetention(); err != nil {
+				zap.L().Named("log").Error("failed to enforce retention", zap.Error(err))
+			}
+		})
+	}
+	if l.Config.Compaction.Enabled {
+		// compactor rewrites closed segments without superseded records
+		l.runPeriodically(l.Config.Compaction.Interval, func() {
+			if _, err := l.Compact(); err != nil {
+				zap.L().Named("log").Error("failed to compact log", zap.Error(err))
+			}
+		})
+	}
+	return nil
+}
+
+// segmentOffsets returns the base offsets of the segments in dir, oldest first.
+func segmentOffsets(dir string) ([]uint64, error) {
+	// Fetch the list of the segments on disk in the log's directory
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// Every segment has exactly one store file, so we use those to find the
+		// segments and ignore the other files that belong to them
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
 		// Trim file's extension from its name
 		offStr := strings.TrimSuffix(
 			file.Name(),
@@ -55,22 +144,31 @@ func (l *Log) setup() error {
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		// baseOffset contains dup for index and store, so we skip
-		// the dup
-		i++
+	return baseOffsets, nil
+}
+
+/*
+runPeriodically starts a background goroutine that calls fn every interval,
+defaulting to a second, until the log is closed.
+*/
+func (l *Log) runPeriodically(interval time.Duration, fn func()) {
+	if interval == 0 {
+		interval = time.Second
 	}
-	if l.segments == nil {
-		if err = l.newSegment(
-			l.Config.Segment.InitialOffset,
-		); err != nil {
-			return err
+	l.background.Add(1)
+	go func(closing chan struct{}) {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case <-ticker.C:
+				fn()
+			}
 		}
-	}
-	return nil
+	}(l.closing)
 }
 
 /*
@@ -96,6 +194,58 @@ configs), then we make a new active segment.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock() // We can optimize this by making the locks per segment level
+	off, err := l.append(record)
+	if err != nil {
+		return 0, err
+	}
+	l.notifyAppended()
+	return off, l.syncAfterAppend(1)
+}
+
+/*
+AppendBatch appends the records to the log under a single lock and applies the
+sync policy once for the whole batch. The records get consecutive offsets and
+AppendBatch returns the first one. If appending a record fails, the records
+before it stay in the log.
+*/
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	first := l.activeSegment.nextOffset
+	// readers can have the records appended before a failure too
+	defer l.notifyAppended()
+	for _, record := range records {
+		if _, err := l.append(record); err != nil {
+			return 0, err
+		}
+	}
+	return first, l.syncAfterAppend(uint64(len(records)))
+}
+
+/*
+appendAt appends a record under the offset it already has instead of the next
+one, leaving a gap if it's higher. Restoring a snapshot of a compacted log uses
+it to keep the records' offsets.
+*/
+func (l *Log) appendAt(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if record.Offset < l.activeSegment.nextOffset {
+		return 0, fmt.Errorf("offset %d is below the log's next offset %d",
+			record.Offset, l.activeSegment.nextOffset)
+	}
+	l.activeSegment.nextOffset = record.Offset
+	off, err := l.append(record)
+	if err != nil {
+		return 0, err
+	}
+	l.notifyAppended()
+	return off, l.syncAfterAppend(1)
+}
+
+// append appends the record to the active segment, rolling over to a new
+// segment once it's full. The caller must hold the write lock and sync.
+func (l *Log) append(record *api.Record) (uint64, error) {
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
@@ -106,14 +256,156 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	return off, err
 }
 
+// notifyAppended wakes up the readers waiting in WaitForOffset. The caller must
+// hold the write lock.
+func (l *Log) notifyAppended() {
+	if l.appended != nil {
+		close(l.appended)
+	}
+	l.appended = make(chan struct{})
+}
+
+// syncAfterAppend applies the SyncAlways and SyncEveryN policies after n records
+// were appended. The caller must hold the write lock.
+func (l *Log) syncAfterAppend(n uint64) error {
+	switch l.Config.Segment.SyncPolicy {
+	case SyncAlways:
+		// the records may have rolled the log over to a new segment
+		return l.syncSegments()
+	case SyncEveryN:
+		l.unsynced += n
+		if l.unsynced < l.Config.Segment.SyncEvery {
+			return nil
+		}
+		l.unsynced = 0
+		return l.syncSegments()
+	}
+	return nil
+}
+
 /*
-Read reads the record stored at the given offset
+Sync commits every record appended so far to stable storage, whatever the
+configured SyncPolicy. Raft's log store calls it so that entries are on disk
+before it acknowledges them.
+*/
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	return l.syncSegments()
+}
+
+// syncSegments syncs every segment with unsynced records. Older segments only
+// have them if the log rolled over since the last sync.
+func (l *Log) syncSegments() error {
+	for _, segment := range l.segments {
+		if err := segment.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Read reads the record stored at the given offset. If compaction removed that
+record, Read returns the next record that's still in the log.
 */
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
+	i, ok := l.segmentFor(off)
+	if !ok {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return l.segments[i].Read(off)
+}
+
+/*
+ReadRange reads the records from offset from onwards, stopping once it has read
+maxRecords records or the next record would take the records over maxBytes in
+size. Zero means no limit. The first record is returned whatever its size, so
+that a reader can always make progress.
+
+Like Read, ReadRange skips over offsets removed by compaction. If a record
+can't be read, ReadRange returns the records before it; reading from the
+record's offset returns the error.
+*/
+func (l *Log) ReadRange(from, maxRecords, maxBytes uint64) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i, ok := l.segmentFor(from)
+	if !ok {
+		return nil, api.ErrOffsetOutOfRange{Offset: from}
+	}
+	var (
+		records []*api.Record
+		size    uint64
+		full    bool
+	)
+	for _, s := range l.segments[i:] {
+		off := from
+		if off < s.baseOffset {
+			off = s.baseOffset
+		}
+		err := s.ReadRange(off, func(record *api.Record) bool {
+			n := uint64(proto.Size(record))
+			if len(records) > 0 && maxBytes > 0 && size+n > maxBytes {
+				full = true
+				return false
+			}
+			records = append(records, record)
+			size += n
+			full = maxRecords > 0 && uint64(len(records)) >= maxRecords
+			return !full
+		})
+		if err != nil {
+			if len(records) > 0 {
+				return records, nil
+			}
+			return nil, err
+		}
+		if full {
+			break
+		}
+	}
+	return records, nil
+}
 
+/*
+WaitForOffset blocks until the log has a record at offset off or later, so
+that a reader at the end of the log can wait for the next record instead of
+polling for it. It returns ctx's error if ctx is done first, and
+api.ErrOffsetOutOfRange if off is before the start of the log since that
+offset will never be appended.
+*/
+func (l *Log) WaitForOffset(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		lowest := l.segments[0].baseOffset
+		next := l.activeSegment.nextOffset
+		appended := l.appended
+		l.mu.RUnlock()
+		if appended == nil {
+			return errLogClosed
+		}
+		if off < lowest {
+			return api.ErrOffsetOutOfRange{Offset: off}
+		}
+		if off < next {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// segmentFor returns the index of the segment holding offset off, and false if
+// no segment does.
+func (l *Log) segmentFor(off uint64) (int, bool) {
 	leftPtr := 0
 	rightPtr := len(l.segments) - 1
 	for leftPtr < rightPtr {
@@ -126,21 +418,62 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 		}
 	}
 	segment := l.segments[leftPtr]
-	if segment.baseOffset <= off && off < segment.nextOffset {
-		s = segment
-	}
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	return leftPtr, segment.baseOffset <= off && off < segment.nextOffset
+}
+
+/*
+OffsetForTime returns the offset of the first record appended at or after the
+given Unix time in nanoseconds. Segments don't necessarily hold increasing
+timestamps, since records can be appended with their own, so we ask each
+segment in turn and the first one that has a new enough record has the answer.
+If every record is older, OffsetForTime returns the offset the next appended
+record will get, which is where a reader interested in that time should start.
+*/
+func (l *Log) OffsetForTime(timestamp int64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		off, ok, err := s.OffsetForTime(timestamp)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
 	}
-	return s.Read(off)
+	return l.activeSegment.nextOffset, nil
 }
 
 /*
 Close iterates over the segments and closes them
 */
 func (l *Log) Close() error {
+	l.stopBackground()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.closeSegments(); err != nil {
+		return err
+	}
+	// wake up the readers waiting for records that won't come
+	if l.appended != nil {
+		close(l.appended)
+		l.appended = nil
+	}
+	return nil
+}
+
+// stopBackground stops the background goroutines. They take the lock, so they
+// have to be stopped before we take the lock ourselves.
+func (l *Log) stopBackground() {
+	if l.closing != nil {
+		close(l.closing)
+		l.background.Wait()
+		l.closing = nil
+	}
+}
+
+// closeSegments closes every segment. The caller must hold the write lock.
+func (l *Log) closeSegments() error {
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -163,9 +496,22 @@ func (l *Log) Remove() error {
 Reset removes the log and then creates a new log to replace it.
 */
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	l.stopBackground()
+	// readers may be waiting on the log while it's replaced, so we hold the lock
+	// throughout and they carry on with the new log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.closeSegments(); err != nil {
 		return err
 	}
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
 	return l.setup()
 }
 
@@ -192,6 +538,8 @@ Truncate() to remove old segments whose data we (hopefully) have processed
 by then and don’t need anymore.
 */
 func (l *Log) Truncate(lowest uint64) error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
@@ -231,6 +579,60 @@ func (l *Log) Reader() io.Reader {
 	return io.MultiReader(readers...)
 }
 
+/*
+snapshot captures the log's store files as they are now, along with their size
+and the offset the log gives the next record, and returns a reader of them.
+Only the capture holds the log's lock.
+
+The snapshot opens the store files for itself, so it goes on reading the files
+as they were even if retention or compaction removes or replaces them while
+it's read, and it stops at the end each store has now, so records appended
+meanwhile aren't included. It has to be closed to release the files.
+*/
+func (l *Log) snapshot() (*logSnapshot, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s := &logSnapshot{next: l.activeSegment.nextOffset}
+	readers := make([]io.Reader, 0, len(l.segments))
+	for _, segment := range l.segments {
+		// records still in the buffer have to be in the file we read
+		if err := segment.store.Flush(); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		f, err := os.Open(segment.store.Name())
+		if err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		readers = append(readers, io.NewSectionReader(f, 0, int64(segment.store.size)))
+		s.size += segment.store.size
+	}
+	s.Reader = io.MultiReader(readers...)
+	return s, nil
+}
+
+// logSnapshot reads a log's store files as they were when Log.snapshot was
+// called.
+type logSnapshot struct {
+	io.Reader
+	files []*os.File
+	// size is the number of bytes the reader reads and next the offset the log
+	// gave the next record when the snapshot was taken
+	size, next uint64
+}
+
+func (s *logSnapshot) Close() error {
+	var err error
+	for _, f := range s.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 type originReader struct {
 	*store
 	off int64
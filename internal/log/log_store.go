@@ -45,16 +45,20 @@ func (l logStore) StoreLog(raftLog *raft.Log) error {
 }
 
 func (l logStore) StoreLogs(raftLogs []*raft.Log) error {
-	for _, raftLog := range raftLogs {
-		if _, err := l.Append(&api.Record{
+	records := make([]*api.Record, len(raftLogs))
+	for i, raftLog := range raftLogs {
+		records[i] = &api.Record{
 			Value: raftLog.Data,
 			Term:  raftLog.Term,
 			Type:  uint32(raftLog.Type),
-		}); err != nil {
-			return err
 		}
 	}
-	return nil
+	if _, err := l.AppendBatch(records); err != nil {
+		return err
+	}
+	// Raft treats stored entries as durable, so they must reach the disk before
+	// we return regardless of the log's sync policy.
+	return l.Sync()
 }
 
 // DeleteRange remove records that are old or stored in a snapshot
@@ -1,12 +1,15 @@
 package log
 
 import (
+	"context"
 	api "github.com/anshulsood11/loghouse/api/v1"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
@@ -14,10 +17,14 @@ func TestLog(t *testing.T) {
 		t *testing.T, log *Log,
 	){
 		"append and read a record succeeds": testAppendRead,
+		"append and read a batch succeeds":  testAppendBatch,
+		"read a range of records":           testReadRange,
+		"wait for offset":                   testWaitForOffset,
 		"offset out of range error":         testOutOfRangeErr,
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"offset for time":                   testOffsetForTime,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -44,6 +51,101 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, recordToAppend.Value, read.Value)
 }
 
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	// the batch is bigger than a segment, so it rolls the log over
+	batch := []*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello again")},
+		{Value: []byte("and again")},
+	}
+	first, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	for i, want := range batch {
+		read, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+	require.Greater(t, len(log.segments), 1)
+}
+
+func testReadRange(t *testing.T, log *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	// every record is in a segment of its own, so the reads span segments
+	require.Len(t, log.segments, 6)
+	n := uint64(proto.Size(&api.Record{
+		Value:     record.Value,
+		Offset:    4,
+		Timestamp: time.Now().UnixNano(),
+	}))
+
+	for _, tc := range []struct {
+		from, maxRecords, maxBytes uint64
+		want                       []uint64
+	}{
+		{from: 0, want: []uint64{0, 1, 2, 3, 4}},
+		{from: 1, maxRecords: 2, want: []uint64{1, 2}},
+		{from: 2, maxBytes: 2 * n, want: []uint64{2, 3}},
+		// the first record is returned even if it's over the byte limit
+		{from: 3, maxBytes: 1, want: []uint64{3}},
+		{from: 4, maxRecords: 10, want: []uint64{4}},
+	} {
+		records, err := log.ReadRange(tc.from, tc.maxRecords, tc.maxBytes)
+		require.NoError(t, err)
+		var got []uint64
+		for _, record := range records {
+			require.Equal(t, []byte("hello world"), record.Value)
+			got = append(got, record.Offset)
+		}
+		require.Equal(t, tc.want, got)
+	}
+
+	_, err := log.ReadRange(5, 0, 0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func testWaitForOffset(t *testing.T, log *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := log.Append(record)
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, log.WaitForOffset(ctx, 0))
+
+	waited := make(chan error)
+	go func() {
+		waited <- log.WaitForOffset(ctx, 2)
+	}()
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	select {
+	case err := <-waited:
+		t.Fatalf("returned before offset 2 was appended: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = log.AppendBatch([]*api.Record{record, record})
+	require.NoError(t, err)
+	select {
+	case err := <-waited:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after offset 2 was appended")
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.WaitForOffset(timeout, 10))
+
+	// offsets removed from the log will never be appended again
+	require.NoError(t, log.Truncate(1))
+	require.IsType(t, api.ErrOffsetOutOfRange{}, log.WaitForOffset(ctx, 0))
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
@@ -83,13 +185,15 @@ func testReader(t *testing.T, log *Log) {
 	off, err := log.Append(recordToAppend)
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), off)
-	reader := log.Reader()
-	b, err := ioutil.ReadAll(reader)
+	frames := newFrameReader(log.Reader())
+	b, err := frames.Next()
 	require.NoError(t, err)
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b, read)
 	require.NoError(t, err)
 	require.Equal(t, recordToAppend.Value, read.Value)
+	_, err = frames.Next()
+	require.Equal(t, io.EOF, err)
 }
 
 func testTruncate(t *testing.T, log *Log) {
@@ -105,3 +209,65 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func TestLogSyncPolicy(t *testing.T) {
+	for scenario, c := range map[string]Config{
+		"always":      syncConfig(SyncAlways, 0, 0),
+		"every n":     syncConfig(SyncEveryN, 2, 0),
+		"on interval": syncConfig(SyncOnInterval, 0, 10*time.Millisecond),
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-sync-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 2; i++ {
+				_, err = log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			// synced records are in the store file without closing the log
+			require.Eventually(t, func() bool {
+				fi, err := os.Stat(log.activeSegment.store.Name())
+				require.NoError(t, err)
+				return uint64(fi.Size()) == log.activeSegment.store.size
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func syncConfig(policy SyncPolicy, every uint64, interval time.Duration) Config {
+	c := Config{}
+	c.Segment.SyncPolicy = policy
+	c.Segment.SyncEvery = every
+	c.Segment.SyncInterval = interval
+	return c
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: start.Add(time.Duration(i) * time.Second).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	for want := uint64(0); want < 6; want++ {
+		off, err := log.OffsetForTime(start.Add(time.Duration(want) * time.Second).UnixNano())
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+	off, err := log.OffsetForTime(start.Add(time.Hour).UnixNano())
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// the time index is reloaded when the log is reopened
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err = log.OffsetForTime(start.Add(2500 * time.Millisecond).UnixNano())
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
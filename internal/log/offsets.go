@@ -0,0 +1,158 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+Consumer groups commit the offset they've consumed a topic up to, so that a
+group's consumers can pick up where the group left off. Topics keeps the
+offsets committed for its topics in memory and in <dir>/offsets, which is
+rewritten on every commit: there's an offset for each group and topic, so the
+file stays small.
+
+The file is a list of entries, each made of the topic's name, the group's name
+and the offset, with the names prefixed by their length.
+*/
+
+// CommitOffset records that the group has consumed the topic up to offset.
+func (t *Topics) CommitOffset(group, topic string, offset uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.topic(topic); err != nil {
+		return err
+	}
+	if t.offsets[topic] == nil {
+		t.offsets[topic] = make(map[string]uint64)
+	}
+	t.offsets[topic][group] = offset
+	return t.saveOffsets()
+}
+
+// FetchOffset returns the offset the group last committed for the topic, and
+// whether it has committed one.
+func (t *Topics) FetchOffset(group, topic string) (uint64, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.topic(topic); err != nil {
+		return 0, false, err
+	}
+	offset, ok := t.offsets[topic][group]
+	return offset, ok, nil
+}
+
+// setOffsets replaces the offsets committed for the topic. The caller must
+// hold the lock.
+func (t *Topics) setOffsets(topic string, offsets map[string]uint64) error {
+	if len(offsets) == 0 {
+		delete(t.offsets, topic)
+	} else {
+		t.offsets[topic] = offsets
+	}
+	return t.saveOffsets()
+}
+
+func (t *Topics) offsetsPath() string {
+	return filepath.Join(t.Dir, "offsets")
+}
+
+// loadOffsets reads the committed offsets from disk. A missing file means
+// nothing has been committed yet.
+func (t *Topics) loadOffsets() error {
+	t.offsets = make(map[string]map[string]uint64)
+	f, err := os.Open(t.offsetsPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		topic, err := readString(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		group, err := readString(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		var offset uint64
+		if err = binary.Read(r, enc, &offset); err != nil {
+			return unexpectedEOF(err)
+		}
+		if t.offsets[topic] == nil {
+			t.offsets[topic] = make(map[string]uint64)
+		}
+		t.offsets[topic][group] = offset
+	}
+}
+
+// saveOffsets writes the committed offsets to a new file that then replaces
+// the old one, so a crash leaves either the old or the new offsets. The caller
+// must hold the lock.
+func (t *Topics) saveOffsets() error {
+	tmp := t.offsetsPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, topic := range sortedKeys(t.offsets) {
+		writeOffsets(w, topic, t.offsets[topic])
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.offsetsPath())
+}
+
+// writeOffsets writes an entry for each of the topic's offsets to w.
+func writeOffsets(w io.Writer, topic string, offsets map[string]uint64) {
+	for _, group := range sortedKeys(offsets) {
+		writeString(w, topic)
+		writeString(w, group)
+		_ = binary.Write(w, enc, offsets[group])
+	}
+}
+
+func writeString(w io.Writer, s string) {
+	_ = binary.Write(w, enc, uint32(len(s)))
+	_, _ = io.WriteString(w, s)
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, enc, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(b), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
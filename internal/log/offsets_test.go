@@ -0,0 +1,58 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCommitOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, topics.CreateTopic("orders"))
+
+	_, committed, err := topics.FetchOffset("billing", "orders")
+	require.NoError(t, err)
+	require.False(t, committed)
+	err = topics.CommitOffset("billing", "missing", 1)
+	require.Equal(t, api.ErrTopicNotFound{Topic: "missing"}, err)
+
+	require.NoError(t, topics.CommitOffset("billing", "orders", 3))
+	require.NoError(t, topics.CommitOffset("billing", "orders", 5))
+	require.NoError(t, topics.CommitOffset("shipping", "orders", 1))
+	require.NoError(t, topics.CommitOffset("billing", DefaultTopic, 7))
+
+	// committed offsets survive reopening the topics
+	require.NoError(t, topics.Close())
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	for _, want := range []struct {
+		group, topic string
+		offset       uint64
+	}{
+		{"billing", "orders", 5},
+		{"shipping", "orders", 1},
+		{"billing", DefaultTopic, 7},
+	} {
+		offset, committed, err := topics.FetchOffset(want.group, want.topic)
+		require.NoError(t, err)
+		require.True(t, committed)
+		require.Equal(t, want.offset, offset)
+	}
+
+	// deleting a topic deletes its offsets
+	require.NoError(t, topics.DeleteTopic("orders"))
+	require.NoError(t, topics.CreateTopic("orders"))
+	_, committed, err = topics.FetchOffset("billing", "orders")
+	require.NoError(t, err)
+	require.False(t, committed)
+	_, committed, err = topics.FetchOffset("billing", DefaultTopic)
+	require.NoError(t, err)
+	require.True(t, committed)
+}
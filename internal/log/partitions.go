@@ -0,0 +1,290 @@
+package log
+
+import (
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+Partitions splits every topic into partitions, with partition p of every topic
+kept in the p-th Topics. Partition 0 lives in the data directory itself, where
+the server's topics lived before topics had partitions, and partition p in
+<dir>/partitions/<p>.
+
+Topics are created and deleted in partition 0, which is what decides whether a
+topic exists and which generation of it does. The other partitions create their
+log of a topic's generation the first time it's used. Partition 0's Topics lock
+is held while they do, so that deleting the topic can't come in between.
+*/
+type Partitions []*Topics
+
+func NewPartitions(dir string, c Config) (Partitions, error) {
+	n := c.Partitions
+	if n == 0 {
+		n = 1
+	}
+	partitions := make(Partitions, 0, n)
+	for p := uint32(0); p < n; p++ {
+		topics, err := NewTopics(partitionDir(dir, p), c)
+		if err != nil {
+			_ = partitions.Close()
+			return nil, err
+		}
+		partitions = append(partitions, topics)
+	}
+	return partitions, nil
+}
+
+func partitionDir(dir string, p uint32) string {
+	if p == 0 {
+		return dir
+	}
+	return filepath.Join(dir, "partitions", strconv.FormatUint(uint64(p), 10))
+}
+
+// PartitionCount returns the number of partitions every topic is split into.
+func (ps Partitions) PartitionCount() uint32 {
+	return uint32(len(ps))
+}
+
+// Topic returns the log of the given partition of the topic, as the generation
+// of the topic partition 0 has.
+func (ps Partitions) Topic(topic string, p uint32) (*Log, error) {
+	log, _, err := ps.topic(topic, p)
+	return log, err
+}
+
+// topic returns the log of the given partition of the topic and the topic's
+// generation.
+func (ps Partitions) topic(topic string, p uint32) (*Log, uint64, error) {
+	if p >= ps.PartitionCount() {
+		return nil, 0, api.ErrPartitionNotFound{Topic: topic, Partition: p}
+	}
+	ps[0].mu.Lock()
+	defer ps[0].mu.Unlock()
+	log, err := ps[0].topic(topic)
+	if err != nil {
+		return nil, 0, err
+	}
+	generation := ps[0].generations[topic]
+	if p != 0 {
+		log, err = ps[p].topicAt(topic, generation)
+	}
+	return log, generation, err
+}
+
+/*
+replicatedTopic returns the log of the given partition of the topic for a write
+made for the given generation, which partition p's group applies. Partition 0's
+group applies the topic's creation and deletion independently of the other
+groups, so when it has applied the generation's creation, the write is only
+applied if the generation is still the topic's. When it hasn't, the generation
+has been created on the leader all the same, and the write is applied. A
+deletion partition 0's group applies later then removes it, so that every
+server ends up without the write whichever order it applied the groups'
+entries in.
+*/
+func (ps Partitions) replicatedTopic(topic string, p uint32, generation uint64) (*Log, error) {
+	if p >= ps.PartitionCount() {
+		return nil, api.ErrPartitionNotFound{Topic: topic, Partition: p}
+	}
+	ps[0].mu.Lock()
+	defer ps[0].mu.Unlock()
+	log, err := ps[0].topic(topic)
+	if _, ok := err.(api.ErrTopicNotFound); err != nil && !ok {
+		return nil, err
+	}
+	if err == nil && ps[0].generations[topic] == generation {
+		if p == 0 {
+			return log, nil
+		}
+		return ps[p].topicAt(topic, generation)
+	}
+	if p == 0 || generation <= ps[0].version {
+		// the generation was deleted, or never existed
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	return ps[p].topicAt(topic, generation)
+}
+
+func (ps Partitions) Append(topic string, p uint32, record *api.Record) (uint64, error) {
+	log, err := ps.Topic(topic, p)
+	if err != nil {
+		return 0, err
+	}
+	return log.Append(record)
+}
+
+func (ps Partitions) AppendBatch(topic string, p uint32, records []*api.Record) (
+	uint64, error) {
+	log, err := ps.Topic(topic, p)
+	if err != nil {
+		return 0, err
+	}
+	return log.AppendBatch(records)
+}
+
+func (ps Partitions) Read(topic string, p uint32, off uint64) (*api.Record, error) {
+	log, err := ps.Topic(topic, p)
+	if err != nil {
+		return nil, err
+	}
+	return log.Read(off)
+}
+
+func (ps Partitions) ReadRange(topic string, p uint32, from, maxRecords, maxBytes uint64) (
+	[]*api.Record, error) {
+	log, err := ps.Topic(topic, p)
+	if err != nil {
+		return nil, err
+	}
+	return log.ReadRange(from, maxRecords, maxBytes)
+}
+
+func (ps Partitions) OffsetForTime(topic string, p uint32, timestamp int64) (uint64, error) {
+	log, err := ps.Topic(topic, p)
+	if err != nil {
+		return 0, err
+	}
+	return log.OffsetForTime(timestamp)
+}
+
+func (ps Partitions) WaitForOffset(ctx context.Context, topic string, p uint32,
+	off uint64) error {
+	if _, err := ps.Topic(topic, p); err != nil {
+		return err
+	}
+	return ps[p].WaitForOffset(ctx, topic, off)
+}
+
+// VerifyLeader returns nil for partitions that exist: the partitions aren't
+// replicated, so reads always see every write.
+func (ps Partitions) VerifyLeader(p uint32) error {
+	if p >= ps.PartitionCount() {
+		return api.ErrPartitionNotFound{Partition: p}
+	}
+	return nil
+}
+
+// CommitOffset records that the group has consumed the topic's partition up
+// to offset.
+func (ps Partitions) CommitOffset(group, topic string, p uint32, offset uint64) error {
+	if _, err := ps.Topic(topic, p); err != nil {
+		return err
+	}
+	return ps[p].CommitOffset(group, topic, offset)
+}
+
+// FetchOffset returns the offset the group last committed for the topic's
+// partition, and whether it has committed one.
+func (ps Partitions) FetchOffset(group, topic string, p uint32) (uint64, bool, error) {
+	if _, err := ps.Topic(topic, p); err != nil {
+		return 0, false, err
+	}
+	return ps[p].FetchOffset(group, topic)
+}
+
+// CreateTopic creates a topic. Its partitions other than partition 0 are
+// created when they're first used.
+func (ps Partitions) CreateTopic(name string) error {
+	return ps[0].CreateTopic(name)
+}
+
+// createTopic creates a topic whose generation is index, the Raft index of the
+// entry that creates it.
+func (ps Partitions) createTopic(name string, index uint64) error {
+	ps[0].mu.Lock()
+	defer ps[0].mu.Unlock()
+	return ps[0].createTopic(name, index)
+}
+
+// DeleteTopic deletes every partition of the topic.
+func (ps Partitions) DeleteTopic(name string) error {
+	return ps.deleteTopic(name, 0)
+}
+
+/*
+deleteTopic deletes every partition of the topic as of index, the Raft index of
+the entry that deletes it, or as of partition 0's next version when it's 0. The
+other partitions keep generations of the topic created after index, which they
+have when partition 0's group is behind theirs.
+*/
+func (ps Partitions) deleteTopic(name string, index uint64) error {
+	ps[0].mu.Lock()
+	defer ps[0].mu.Unlock()
+	if index == 0 {
+		index = ps[0].version + 1
+	}
+	if err := ps[0].deleteTopic(name, index); err != nil {
+		return err
+	}
+	for _, topics := range ps[1:] {
+		if err := topics.deleteBefore(name, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTopics returns the names of the topics in order. The default topic isn't
+// listed.
+func (ps Partitions) ListTopics() ([]string, error) {
+	return ps[0].ListTopics()
+}
+
+// dropDeletedTopics deletes the partitions of topic generations that partition
+// 0 no longer has, which happens when partition 0 is restored from a snapshot.
+// Generations partition 0 hasn't got to yet are kept.
+func (ps Partitions) dropDeletedTopics() error {
+	ps[0].mu.Lock()
+	defer ps[0].mu.Unlock()
+	names, err := ps[0].names()
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(names))
+	for _, name := range names {
+		exists[name] = true
+	}
+	for _, topics := range ps[1:] {
+		names, err := topics.ListTopics()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			topics.mu.Lock()
+			generation := topics.generations[name]
+			topics.mu.Unlock()
+			if exists[name] && generation == ps[0].generations[name] ||
+				generation > ps[0].version {
+				continue
+			}
+			if err = topics.DeleteTopic(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes every partition's topics.
+func (ps Partitions) Close() error {
+	for _, topics := range ps {
+		if err := topics.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove closes every partition's topics and removes their data.
+func (ps Partitions) Remove() error {
+	for _, topics := range ps {
+		if err := topics.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Partitions = 3
+	partitions, err := NewPartitions(dir, c)
+	require.NoError(t, err)
+	defer partitions.Close()
+	require.Equal(t, uint32(3), partitions.PartitionCount())
+
+	// partitions have their own offsets
+	for p := uint32(0); p < 3; p++ {
+		off, err := partitions.Append(DefaultTopic, p, &api.Record{Value: []byte("default")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	_, err = partitions.Append(DefaultTopic, 3, &api.Record{Value: []byte("lost")})
+	require.Equal(t, api.ErrPartitionNotFound{Topic: DefaultTopic, Partition: 3}, err)
+
+	// a topic exists once partition 0 has it, and its other partitions are
+	// created when they're first used
+	_, err = partitions.Read("orders", 1, 0)
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+	require.NoError(t, partitions.CreateTopic("orders"))
+	_, err = os.Stat(filepath.Join(dir, "partitions", "2", "topics", "orders"))
+	require.True(t, os.IsNotExist(err))
+	first, err := partitions.AppendBatch("orders", 2, []*api.Record{
+		{Value: []byte("order 0")},
+		{Value: []byte("order 1")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	records, err := partitions.ReadRange("orders", 2, 0, 10, 1<<20)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	_, err = partitions.Read("orders", 1, 0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	// deleting a topic deletes all of its partitions
+	require.NoError(t, partitions.DeleteTopic("orders"))
+	for p := uint32(0); p < 3; p++ {
+		names, err := partitions[p].ListTopics()
+		require.NoError(t, err)
+		require.Empty(t, names)
+	}
+
+	// partitions of topics that partition 0 no longer has are dropped
+	_, err = partitions[1].topicAt("stale", 1)
+	require.NoError(t, err)
+	require.NoError(t, partitions.dropDeletedTopics())
+	names, err := partitions[1].ListTopics()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+/*
+The groups of partitions 0 and 1 apply their entries independently, so servers
+may apply a write to partition 1 of a topic before or after partition 0 deletes
+the topic, and every server has to end up with the same partition 1.
+*/
+func TestReplicatedTopicGenerations(t *testing.T) {
+	c := Config{}
+	c.Partitions = 2
+	newServer := func() (Partitions, raft.FSM, raft.FSM) {
+		dir := t.TempDir()
+		partitions, err := NewPartitions(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { partitions.Close() })
+		return partitions, &fsm{partitions: partitions, partition: 0},
+			&fsm{partitions: partitions, partition: 1}
+	}
+	entry := func(index uint64, reqType RequestType, req proto.Message) *raft.Log {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		return &raft.Log{Index: index, Data: append([]byte{byte(reqType)}, b...)}
+	}
+	create := func(index uint64) *raft.Log {
+		return entry(index, CreateTopicRequestType, &api.CreateTopicRequest{Name: "orders"})
+	}
+	deleteTopic := entry(2, DeleteTopicRequestType, &api.DeleteTopicRequest{Name: "orders"})
+	// partition 1's first write was made for the topic partition 0 created at
+	// index 1
+	write := func(index, generation uint64) *raft.Log {
+		return entry(index, AppendRequestType, &api.ProduceRequest{
+			Record:          &api.Record{Value: []byte("order")},
+			Topic:           "orders",
+			Partition:       1,
+			TopicGeneration: generation,
+		})
+	}
+
+	before, before0, before1 := newServer()
+	require.IsType(t, &api.CreateTopicResponse{}, before0.Apply(create(1)))
+	require.IsType(t, &api.ProduceResponse{}, before1.Apply(write(1, 1)))
+	require.IsType(t, &api.DeleteTopicResponse{}, before0.Apply(deleteTopic))
+
+	after, after0, after1 := newServer()
+	require.IsType(t, &api.CreateTopicResponse{}, after0.Apply(create(1)))
+	require.IsType(t, &api.DeleteTopicResponse{}, after0.Apply(deleteTopic))
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, after1.Apply(write(1, 1)))
+
+	// a server whose partition 0 is behind applies the write, and the deletion
+	// removes it later
+	behind, behind0, behind1 := newServer()
+	require.IsType(t, &api.ProduceResponse{}, behind1.Apply(write(1, 1)))
+	require.IsType(t, &api.CreateTopicResponse{}, behind0.Apply(create(1)))
+	require.IsType(t, &api.DeleteTopicResponse{}, behind0.Apply(deleteTopic))
+
+	// the topic created again starts partition 1 over on every server, and the
+	// deleted generation's writes aren't applied to it
+	for _, server := range []struct {
+		partitions Partitions
+		fsm0, fsm1 raft.FSM
+	}{{before, before0, before1}, {after, after0, after1}, {behind, behind0, behind1}} {
+		_, err := server.partitions.Read("orders", 1, 0)
+		require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+		require.IsType(t, &api.CreateTopicResponse{}, server.fsm0.Apply(create(3)))
+		require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, server.fsm1.Apply(write(2, 1)))
+		res := server.fsm1.Apply(write(3, 3))
+		require.Equal(t, &api.ProduceResponse{Offset: 0}, res)
+		records, err := server.partitions.ReadRange("orders", 1, 0, 10, 1<<20)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+	}
+}
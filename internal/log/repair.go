@@ -0,0 +1,272 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/golang/protobuf/proto"
+	"go.etcd.io/bbolt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+/*
+CheckStopped returns an error if a server is running with its data in dataDir.
+A DistributedLog keeps each partition's Raft stable store, a Bolt database,
+open with an exclusive lock, so we try to open the stores ourselves.
+*/
+func CheckStopped(dataDir string) error {
+	partitions, err := partitionsIn(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		stable := filepath.Join(partitionDir(dataDir, p), "raft", "stable")
+		if _, err := os.Stat(stable); os.IsNotExist(err) {
+			continue
+		}
+		db, err := bbolt.Open(stable, 0600, &bbolt.Options{
+			ReadOnly: true,
+			Timeout:  100 * time.Millisecond,
+		})
+		if err == bbolt.ErrTimeout {
+			return fmt.Errorf("%s is in use by a running server", dataDir)
+		}
+		if err != nil {
+			return err
+		}
+		if err = db.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SegmentRepair is what RepairLog or RebuildLog did to a segment.
+type SegmentRepair struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// Records is the number of records in the segment's rebuilt index.
+	Records uint64 `json:"records"`
+	// DroppedRecords is the number of whole frames left out of the index because
+	// the record in them is corrupt.
+	DroppedRecords uint64 `json:"dropped_records"`
+	// TruncatedBytes is the number of bytes cut off the end of the store.
+	TruncatedBytes uint64 `json:"truncated_bytes"`
+}
+
+/*
+RepairLog repairs the segments of the log in dir that VerifyLog finds records
+may have been lost from, rebuilding them the way RebuildLog does. Segments whose
+only issues are offset gaps or preallocated indexes are left alone; opening the
+log takes care of those.
+
+Like RebuildLog, it's meant for a stopped server: the log mustn't be open.
+*/
+func RepairLog(dir string, c Config, truncate bool) ([]SegmentRepair, error) {
+	return repairLog(dir, c, false, truncate)
+}
+
+/*
+RebuildLog rebuilds the index and time index of every segment of the log in dir
+from the records in its store, which hold their own offsets. It's how a log
+whose index files are lost or corrupt is brought back; opening such a log would
+instead drop the records its index doesn't point at.
+
+The store is read frame by frame. A whole frame whose record is corrupt is left
+out of the index; its bytes stay in the store, where VerifyLog goes on reporting
+them, so they can still be looked at. A frame that runs past the end of the
+store is a torn write, or a corrupt length we can't skip over. The store is
+truncated at the end of the last good frame before it when nothing after it can
+be read, as after a torn write. If an intact record follows, the length was
+corrupted instead, and truncating would drop that record and any after it, so
+the segment is left alone and an error returned unless truncate is set. Stores
+from before records had checksums are always truncated, since there's no
+telling a record from bytes that happen to look like one. The
+rebuilt indexes replace the old ones before the store is truncated, so they
+never point past its end.
+
+The log mustn't be open while it's rebuilt.
+*/
+func RebuildLog(dir string, c Config, truncate bool) ([]SegmentRepair, error) {
+	return repairLog(dir, c, true, truncate)
+}
+
+func repairLog(dir string, c Config, all, truncate bool) ([]SegmentRepair, error) {
+	c = withDefaults(c)
+	// finish interrupted compactions first, or they'd replace the repaired
+	// segments when the log is next opened
+	if err := (&Log{Dir: dir}).finishCompactions(); err != nil {
+		return nil, err
+	}
+	var repairs []SegmentRepair
+	err := eachSegment(dir, func(s *segment) error {
+		if !all {
+			issues, err := verifySegment(s)
+			if err != nil {
+				return err
+			}
+			corrupt := false
+			for _, issue := range issues {
+				corrupt = corrupt || issue.Corrupt()
+			}
+			if !corrupt {
+				return nil
+			}
+		}
+		repair, err := rebuildSegment(dir, s, c, truncate)
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", s.baseOffset, err)
+		}
+		repairs = append(repairs, repair)
+		return nil
+	})
+	return repairs, err
+}
+
+// rebuildSegment rebuilds the indexes of a segment opened by
+// openSegmentReadOnly, as RebuildLog describes.
+func rebuildSegment(dir string, s *segment, c Config, truncate bool) (SegmentRepair, error) {
+	repair := SegmentRepair{BaseOffset: s.baseOffset}
+	name := func(ext string) string {
+		return path.Join(dir, fmt.Sprintf("%d%s", s.baseOffset, ext))
+	}
+	timeIndexFile, err := os.Create(name(".timeindex.repair"))
+	if err != nil {
+		return repair, err
+	}
+	defer os.Remove(timeIndexFile.Name())
+	defer timeIndexFile.Close()
+	s.config = c
+	s.timeIndex = &timeIndex{file: timeIndexFile}
+
+	var entries []byte
+	overhead := frameOverhead(s.store.version)
+	end, next := s.store.dataStart(), s.baseOffset
+	for pos := end; pos+overhead <= s.store.size; {
+		meta := make([]byte, lenWidth)
+		if _, err = s.store.ReadAt(meta, int64(pos)); err != nil {
+			return repair, err
+		}
+		size := enc.Uint64(meta)
+		if size > s.store.size-pos-overhead {
+			if truncate {
+				break
+			}
+			intact, ok, err := intactFrameAfter(s, pos, next)
+			if err != nil {
+				return repair, err
+			}
+			if ok {
+				return repair, fmt.Errorf("the frame at %d runs past the end of the store, "+
+					"but an intact record follows at %d that truncating would drop", pos, intact)
+			}
+			break
+		}
+		frameEnd := pos + overhead + size
+		record, err := s.readAt(pos, next)
+		if err == nil && (record.Offset < next || record.Offset-s.baseOffset > math.MaxUint32) {
+			// the frame is intact, but it can't hold the next record
+			err = api.ErrCorruptRecord{Offset: record.Offset}
+		}
+		if errors.As(err, &api.ErrCorruptRecord{}) {
+			repair.DroppedRecords++
+			pos = frameEnd
+			continue
+		}
+		if err != nil {
+			return repair, err
+		}
+		entry := make([]byte, entWidth)
+		enc.PutUint32(entry[:offWidth], uint32(record.Offset-s.baseOffset))
+		enc.PutUint64(entry[offWidth:], pos)
+		entries = append(entries, entry...)
+		s.nextOffset = record.Offset
+		if err = s.indexTime(record.Timestamp, pos); err != nil {
+			return repair, err
+		}
+		repair.Records++
+		next = record.Offset + 1
+		pos, end = frameEnd, frameEnd
+	}
+
+	if err = writeFileSync(name(".index.repair"), entries); err != nil {
+		return repair, err
+	}
+	if err = os.Rename(name(".index.repair"), name(".index")); err != nil {
+		return repair, err
+	}
+	if err = timeIndexFile.Sync(); err != nil {
+		return repair, err
+	}
+	if err = os.Rename(timeIndexFile.Name(), name(".timeindex")); err != nil {
+		return repair, err
+	}
+	if end < s.store.size {
+		if err = os.Truncate(s.store.Name(), int64(end)); err != nil {
+			return repair, err
+		}
+		repair.TruncatedBytes = s.store.size - end
+	}
+	return repair, nil
+}
+
+/*
+intactFrameAfter looks for a whole frame past pos holding a record that could
+come after offset next, and returns its position. The rest of the store is read
+once and searched in memory. Only frames that pass their checksums count, so a
+record found is one that was written there, not bytes in another record's
+payload that happen to parse; stores from before checksums can't tell the two
+apart, so nothing is looked for in them.
+*/
+func intactFrameAfter(s *segment, pos, next uint64) (uint64, bool, error) {
+	if s.store.version < storeVersionCRC {
+		return 0, false, nil
+	}
+	overhead := frameOverhead(s.store.version)
+	tail := make([]byte, s.store.size-pos)
+	if _, err := s.store.ReadAt(tail, int64(pos)); err != nil {
+		return 0, false, err
+	}
+	for i := uint64(1); i+overhead <= uint64(len(tail)); i++ {
+		meta := tail[i : i+overhead]
+		size := enc.Uint64(meta[:lenWidth])
+		if size > uint64(len(tail))-i-overhead {
+			continue
+		}
+		p := tail[i+overhead : i+overhead+size]
+		codec := frameCodec(s.store.version, meta)
+		if verifyChecksum(s.store.version, codec, p, enc.Uint32(meta[lenWidth:])) != nil {
+			continue
+		}
+		p, err := decompress(codec, p)
+		if err != nil {
+			continue
+		}
+		record := &api.Record{}
+		if proto.Unmarshal(p, record) != nil {
+			continue
+		}
+		if record.Offset >= next && record.Offset-s.baseOffset <= math.MaxUint32 {
+			return pos + i, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// writeFileSync writes b to the named file and commits it to stable storage.
+func writeFileSync(name string, b []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
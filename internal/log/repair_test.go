@@ -0,0 +1,195 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/golang/protobuf/proto"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRebuildLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rebuild-log-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.TimeIndexInterval = 1
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := int64(1); i <= 5; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world"), Timestamp: i})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// the first segment loses its indexes and the second gets a torn write
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.index")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.timeindex"), []byte("garbage"), 0644))
+	f, err := os.OpenFile(filepath.Join(dir, "3.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	repairs, err := RebuildLog(dir, c, false)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{
+		{BaseOffset: 0, Records: 3},
+		{BaseOffset: 3, Records: 2, TruncatedBytes: 11},
+	}, repairs)
+	issues, err := VerifyLog(dir)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 5; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := l.OffsetForTime(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = l.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestRepairLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "repair-log-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, pos, err := l.segments[0].index.Read(1)
+	require.NoError(t, err)
+	version := l.segments[0].store.version
+	require.NoError(t, l.Close())
+
+	// a flipped bit breaks the second record
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+frameOverhead(version)))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 1}, int64(pos+frameOverhead(version)))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// only the broken segment is rebuilt, without the broken record
+	repairs, err := RepairLog(dir, c, false)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{{BaseOffset: 0, Records: 2, DroppedRecords: 1}}, repairs)
+	issues, err := VerifyLog(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(issues), issues)
+	require.Equal(t, IssueOffsetGap, issues[0].Kind)
+	require.Equal(t, IssueUnindexedBytes, issues[1].Kind)
+
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	var offsets []uint64
+	records, err := l.ReadRange(0, 10, 0)
+	require.NoError(t, err)
+	for _, record := range records {
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{0, 2, 3, 4}, offsets)
+}
+
+func TestRebuildLogCorruptLength(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rebuild-log-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, pos, err := l.segments[0].index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// the second record's length now runs past the end of the store
+	store := filepath.Join(dir, "0.store")
+	f, err := os.OpenFile(store, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 0, 0, 1, 0, 0}, int64(pos))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	before, err := os.Stat(store)
+	require.NoError(t, err)
+
+	// the intact record after it isn't cut off unless we ask for it
+	_, err = RebuildLog(dir, c, false)
+	require.Error(t, err)
+	after, err := os.Stat(store)
+	require.NoError(t, err)
+	require.Equal(t, before.Size(), after.Size())
+	issues, err := VerifyLog(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(issues), issues)
+	require.Equal(t, IssueCorruptRecord, issues[0].Kind)
+
+	repairs, err := RebuildLog(dir, c, true)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{
+		{BaseOffset: 0, Records: 1, TruncatedBytes: uint64(before.Size()) - pos},
+	}, repairs)
+}
+
+func TestRebuildLegacyLogCorruptLength(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rebuild-log-test")
+	defer os.RemoveAll(dir)
+	// a store from before frames had checksums, whose second frame's length runs
+	// past the end of the store
+	var b []byte
+	var first uint64
+	for off := uint64(0); off < 3; off++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: off})
+		require.NoError(t, err)
+		size := uint64(len(p))
+		if off == 1 {
+			size = 1 << 16
+		}
+		b = enc.AppendUint64(b, size)
+		b = append(b, p...)
+		if off == 0 {
+			first = uint64(len(b))
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.store"), b, 0644))
+
+	// without checksums, the record after it can't be told from payload bytes,
+	// so the store is truncated at the corrupt frame
+	repairs, err := RebuildLog(dir, Config{}, false)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{
+		{BaseOffset: 0, Records: 1, TruncatedBytes: uint64(len(b)) - first},
+	}, repairs)
+}
+
+func TestCheckStopped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "check-stopped-test")
+	defer os.RemoveAll(dir)
+	require.NoError(t, CheckStopped(dir))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "partitions", "1", "raft"), 0755))
+	// a running server keeps its Raft stable stores open
+	stable, err := raftboltdb.NewBoltStore(filepath.Join(dir, "partitions", "1", "raft", "stable"))
+	require.NoError(t, err)
+	require.Error(t, CheckStopped(dir))
+	require.NoError(t, stable.Close())
+	require.NoError(t, CheckStopped(dir))
+}
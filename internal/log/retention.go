@@ -0,0 +1,95 @@
+package log
+
+import (
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+// RetentionReport describes the segments removed by a retention pass.
+type RetentionReport struct {
+	Segments int
+	Records  uint64
+	Bytes    uint64
+	// LowestOffset is the log's lowest offset once the segments are removed.
+	LowestOffset uint64
+}
+
+func retentionEnabled(c Config) bool {
+	return c.Retention.MaxBytes != 0 ||
+		c.Retention.MaxSegmentAge != 0 ||
+		c.Retention.MaxRecords != 0
+}
+
+/*
+EnforceRetention removes the oldest segments until the log is within the limits
+in Config.Retention. A segment is only removed if every segment before it is
+too, so the log never ends up with holes, and the active segment is always
+kept. The background cleaner calls this every Retention.CheckInterval.
+*/
+func (l *Log) EnforceRetention() (RetentionReport, error) {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	retention := l.Config.Retention
+	var totalBytes, totalRecords uint64
+	for _, s := range l.segments {
+		totalBytes += s.store.size
+		totalRecords += s.nextOffset - s.baseOffset
+	}
+	cutoff := time.Now().Add(-retention.MaxSegmentAge)
+	var report RetentionReport
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		lastModified, err := s.lastModified()
+		if err != nil {
+			return report, err
+		}
+		expired := (retention.MaxBytes != 0 && totalBytes > retention.MaxBytes) ||
+			(retention.MaxRecords != 0 && totalRecords > retention.MaxRecords) ||
+			(retention.MaxSegmentAge != 0 && lastModified.Before(cutoff))
+		if !expired {
+			break
+		}
+		records := s.nextOffset - s.baseOffset
+		bytes := s.store.size
+		if err := s.Remove(); err != nil {
+			return report, err
+		}
+		l.segments = l.segments[1:]
+		totalBytes -= bytes
+		totalRecords -= records
+		report.Segments++
+		report.Records += records
+		report.Bytes += bytes
+	}
+	report.LowestOffset = l.segments[0].baseOffset
+	if report.Segments > 0 {
+		zap.L().Named("log").Info(
+			"removed segments past retention",
+			zap.String("dir", l.Dir),
+			zap.Int("segments", report.Segments),
+			zap.Uint64("records", report.Records),
+			zap.Uint64("bytes", report.Bytes),
+			zap.Uint64("lowest_offset", report.LowestOffset),
+		)
+	}
+	return report, nil
+}
+
+/*
+lastModified returns when the segment's newest record was appended. Segments
+written before records carried timestamps fall back to their store file's
+modification time.
+*/
+func (s *segment) lastModified() (time.Time, error) {
+	if s.maxTimestamp != 0 {
+		return time.Unix(0, s.maxTimestamp), nil
+	}
+	fi, err := os.Stat(s.store.Name())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
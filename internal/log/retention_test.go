@@ -0,0 +1,90 @@
+package log
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnforceRetention(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		configure  func(c *Config)
+		wantLowest uint64
+	}{
+		"max records": {
+			configure:  func(c *Config) { c.Retention.MaxRecords = 1 },
+			wantLowest: 3,
+		},
+		"max bytes": {
+			configure:  func(c *Config) { c.Retention.MaxBytes = 1 },
+			wantLowest: 4,
+		},
+		"max segment age": {
+			configure:  func(c *Config) { c.Retention.MaxSegmentAge = time.Hour },
+			wantLowest: 2,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			// one record per segment
+			c.Segment.MaxStoreBytes = 32
+			tc.configure(&c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// the first two records are two hours old
+			for i := 0; i < 4; i++ {
+				record := &api.Record{Value: []byte("hello world")}
+				if i < 2 {
+					record.Timestamp = time.Now().Add(-2 * time.Hour).UnixNano()
+				}
+				_, err := log.Append(record)
+				require.NoError(t, err)
+			}
+
+			report, err := log.EnforceRetention()
+			require.NoError(t, err)
+			require.Equal(t, int(tc.wantLowest), report.Segments)
+			require.Equal(t, tc.wantLowest, report.Records)
+			require.Equal(t, tc.wantLowest, report.LowestOffset)
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, tc.wantLowest, lowest)
+			_, err = log.Read(tc.wantLowest - 1)
+			require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+			// the active segment is kept and still takes appends
+			off, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), off)
+		})
+	}
+}
+
+func TestRetentionCleaner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-cleaner-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Retention.MaxRecords = 1
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		return lowest == 2
+	}, time.Second, 10*time.Millisecond)
+}
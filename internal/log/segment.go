@@ -1,19 +1,28 @@
 package log
 
 import (
+	"errors"
 	"fmt"
 	api "github.com/anshulsood11/loghouse/api/v1"
 	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
 	"os"
 	"path"
+	"time"
 )
 
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	nextOffset, baseOffset uint64 //next and base offsets to know what offset to append new
 	// records under and to calculate the relative offsets for the index entries
-	config Config
+	config   Config
+	unsynced uint64 // records appended since the segment was last synced
+	// maxTimestamp is the latest timestamp of any record in the segment and
+	// timeIndexPos the store position of the record last added to the time index
+	maxTimestamp int64
+	timeIndexPos uint64
 }
 
 // The log calls newSegment() when it needs to add a new segment, such as when
@@ -47,6 +56,9 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		// If index is empty, then the next record appended to the segment would be the
 		// first record and its offset would be the segment’s base offset.
@@ -56,23 +68,166 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		// written should take the offset at the end of the segment
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
+	if err = s.loadMaxTimestamp(); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+/*
+loadMaxTimestamp restores the segment's latest timestamp when it's reopened.
+The last time index entry covers every record up to its offset, so we only have
+to read the records appended after it. Entries for records that recovery
+dropped from the store are removed first.
+*/
+func (s *segment) loadMaxTimestamp() error {
+	if err := s.timeIndex.TruncateAfter(uint32(s.nextOffset - s.baseOffset)); err != nil {
+		return err
+	}
+	from := s.baseOffset
+	if e, ok := s.timeIndex.Last(); ok {
+		s.maxTimestamp = e.timestamp
+		from += uint64(e.off) + 1
+	}
+	for off := from; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if errors.As(err, &api.ErrCorruptRecord{}) {
+			// a corrupt record shouldn't keep the rest of the log from opening
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if record.Timestamp > s.maxTimestamp {
+			s.maxTimestamp = record.Timestamp
+		}
+		// skip over any offsets removed by compaction
+		off = record.Offset
+	}
+	s.timeIndexPos = s.store.size
+	return nil
+}
+
+/*
+recover brings the index and store back in line with each other after an
+unclean shutdown. The index is only truncated to its real size when it's closed,
+so if the process dies the index file still has its preallocated size and ends
+in zeroed entries, and the store may be missing buffered records or end in a
+partially written one.
+
+We walk the index backwards to find the last entry that belongs to the segment
+and points at a whole frame in the store. Entries after it are dropped and the
+store is truncated to the end of that frame. Only frames that run past the end
+of the store, as torn writes do, are dropped: a whole frame whose checksum
+doesn't match is corruption rather than a write cut short, so it's reported and
+left in place for loghouse-admin verify and repair to deal with, and reading it
+fails as reading any corrupt record does. A cleanly closed segment passes the
+check on its last entry and is left untouched.
+*/
+func (s *segment) recover() error {
+	var valid, dropped uint64
+	droppedFrom := s.baseOffset
+	end := s.store.dataStart()
+	for i := s.index.size / entWidth; i > 0; i-- {
+		off, pos, err := s.index.Read(int64(i - 1))
+		if err != nil {
+			return err
+		}
+		// Entries are written in increasing offset order, so the entry at i holds
+		// relative offset i, or a later one if compaction removed records before
+		// it. Zeroed entries past the end of the index don't.
+		if uint64(off) < i-1 || pos < s.store.dataStart() {
+			continue
+		}
+		frameEnd, whole, err := s.store.frameSpan(pos)
+		if err != nil {
+			return err
+		}
+		if !whole {
+			// The entry was written but its record never fully made it to disk.
+			dropped++
+			droppedFrom = s.baseOffset + uint64(off)
+			continue
+		}
+		if _, _, err = s.store.Read(pos); errors.Is(err, errCorruptFrame) {
+			zap.L().Named("log").Error(
+				"corrupt record at the end of the segment, kept for repair",
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Uint64("offset", s.baseOffset+uint64(off)),
+				zap.Uint64("position", pos),
+				zap.Error(err),
+			)
+		} else if err != nil {
+			return err
+		}
+		valid, end = i, frameEnd
+		break
+	}
+	truncated := s.store.size - end
+	if s.index.size == valid*entWidth && truncated == 0 {
+		return nil
+	}
+	s.index.size = valid * entWidth
+	if truncated > 0 {
+		if err := s.store.truncate(end); err != nil {
+			return err
+		}
+	}
+	fields := []zap.Field{
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Uint64("records", valid),
+		zap.Uint64("dropped_records", dropped),
+		zap.Uint64("truncated_store_bytes", truncated),
+		zap.Uint64("truncated_at", end),
+	}
+	if dropped > 0 {
+		// records may have been acknowledged before they were synced
+		zap.L().Named("log").Warn("dropped torn records after unclean shutdown",
+			append(fields, zap.Uint64("first_dropped_offset", droppedFrom))...)
+		return nil
+	}
+	zap.L().Named("log").Info("recovered segment after unclean shutdown", fields...)
+	return nil
+}
+
 /*
 Append writes the record to the segment and returns the newly appended
 record’s offset. The log returns the offset to the API response. The segment
 appends a record in a two-step process: it appends the data to the store and
 then adds an index entry.
+
+The record is appended at the segment's next offset. To keep a record's offset,
+as compaction and snapshot restores do, callers move nextOffset up to it first.
 */
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
-	_, pos, err := s.store.Append(p)
+	// stores written before codecs existed keep taking uncompressed records
+	codec := s.config.Segment.Codec
+	if s.store.version < storeVersionCodec {
+		codec = CodecNone
+	}
+	if p, err = compress(codec, p); err != nil {
+		return 0, err
+	}
+	_, pos, err := s.store.Append(p, codec)
 	if err != nil {
 		return 0, err
 	}
@@ -83,30 +238,144 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	); err != nil {
 		return 0, err
 	}
+	if err = s.indexTime(record.Timestamp, pos); err != nil {
+		return 0, err
+	}
 	// increment the next offset to prep for a future append call
 	s.nextOffset++
+	s.unsynced++
 	return cur, nil
 }
 
+/*
+indexTime adds an entry to the time index for the record being appended at pos
+once the store has grown by Segment.TimeIndexInterval bytes since the last
+entry. The first record of a segment is always indexed.
+*/
+func (s *segment) indexTime(timestamp int64, pos uint64) error {
+	if timestamp > s.maxTimestamp {
+		s.maxTimestamp = timestamp
+	}
+	last, ok := s.timeIndex.Last()
+	if ok && (s.maxTimestamp <= last.timestamp ||
+		pos-s.timeIndexPos < s.config.Segment.TimeIndexInterval) {
+		return nil
+	}
+	if err := s.timeIndex.Write(
+		s.maxTimestamp,
+		uint32(s.nextOffset-s.baseOffset),
+	); err != nil {
+		return err
+	}
+	s.timeIndexPos = pos
+	return nil
+}
+
+/*
+Sync commits the segment's records to stable storage. The store is synced before
+the index so that a synced index entry never points at a record that isn't.
+*/
+func (s *segment) Sync() error {
+	if s.unsynced == 0 {
+		return nil
+	}
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Sync(); err != nil {
+		return err
+	}
+	s.unsynced = 0
+	return nil
+}
+
 /*
 Read returns the record for the given offset. Similar to writes, to read
 a record the segment must first translate the absolute index into a relative
 offset and get the associated index entry. Once it has the index entry, the
 segment can go straight to the record’s position in the store and read the
-proper amount of data.
+proper amount of data, decompressing it with the codec stored in its frame. If
+the stored frame fails its integrity checks or doesn't hold a record, Read
+returns api.ErrCorruptRecord.
+
+If compaction removed the record at off, Read returns the next record that's
+still in the segment, so callers should check the returned record's offset.
 */
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	_, pos, err := s.index.Find(uint32(off - s.baseOffset))
 	if err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	return s.readAt(pos, off)
+}
+
+/*
+ReadRange calls fn with each record in the segment from offset off onwards, in
+order, until fn returns false. It goes through the index entries one after the
+other instead of looking each offset up, so offsets removed by compaction cost
+nothing.
+*/
+func (s *segment) ReadRange(off uint64, fn func(*api.Record) bool) error {
+	for entry := s.index.search(uint32(off - s.baseOffset)); entry < s.index.entries(); entry++ {
+		out, pos, err := s.index.Read(entry)
+		if err != nil {
+			return err
+		}
+		record, err := s.readAt(pos, s.baseOffset+uint64(out))
+		if err != nil {
+			return err
+		}
+		if !fn(record) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readAt reads the record for offset off stored at pos in the store.
+func (s *segment) readAt(pos, off uint64) (*api.Record, error) {
+	p, codec, err := s.store.Read(pos)
+	if err == nil {
+		p, err = decompress(codec, p)
+	}
+	if errors.Is(err, errCorruptFrame) {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
 	if err != nil {
 		return nil, err
 	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
+	return record, nil
+}
+
+/*
+OffsetForTime returns the offset of the first record in the segment appended at
+or after timestamp. ok is false if every record in the segment is older. The
+time index tells us where to start reading from, and we read records from there
+until we find one that's new enough.
+*/
+func (s *segment) OffsetForTime(timestamp int64) (offset uint64, ok bool, err error) {
+	if s.maxTimestamp < timestamp {
+		return 0, false, nil
+	}
+	from := s.baseOffset + uint64(s.timeIndex.Lookup(timestamp))
+	for off := from; off < s.nextOffset; off++ {
+		record, err := s.Read(off)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= timestamp {
+			return record.Offset, true, nil
+		}
+		off = record.Offset
+	}
+	return 0, false, nil
 }
 
 /*
@@ -134,6 +403,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -141,6 +413,9 @@ func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -1,7 +1,9 @@
 package log
 
 import (
+	"bytes"
 	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
@@ -46,3 +48,134 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentRecover(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-recover-test")
+	defer os.RemoveAll(dir)
+	want := &api.Record{Value: []byte("hello world")}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	// reading flushes the store's buffer, so the first three records reach the
+	// file while the fourth is lost with the buffer when the process dies
+	_, err = s.Read(18)
+	require.NoError(t, err)
+	end := s.store.size
+	_, err = s.Append(want)
+	require.NoError(t, err)
+	// a torn write leaves part of a record at the end of the store
+	_, err = s.store.File.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+
+	// the segment is never closed, so the index keeps its preallocated size
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, 3*entWidth, s.index.size)
+	require.Equal(t, end, s.store.size)
+	for off := uint64(16); off < 19; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentRecoverCorruptRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-recover-test")
+	defer os.RemoveAll(dir)
+	want := &api.Record{Value: []byte("hello world")}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	_, pos, err := s.index.Read(2)
+	require.NoError(t, err)
+	require.NoError(t, s.store.Flush())
+	// a flipped bit in the last record is corruption, not a torn write
+	b := make([]byte, 1)
+	at := int64(pos + frameOverhead(s.store.version))
+	_, err = s.store.File.ReadAt(b, at)
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 1}, at)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	size := s.store.size
+
+	// so the record is kept for verify and repair rather than cut off
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, size, s.store.size)
+	_, err = s.Read(18)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 18}, err)
+	got, err := s.Read(17)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+}
+
+func TestSegmentMixedCodecs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-mixed-codecs-test")
+	defer os.RemoveAll(dir)
+	want := &api.Record{Value: bytes.Repeat([]byte("hello world "), 16)}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 1024
+	codecs := []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd}
+	var sizes []uint64
+	for _, codec := range codecs {
+		// reopening the segment with another codec keeps the records already
+		// in it readable
+		c.Segment.Codec = codec
+		s, err := newSegment(dir, 16, c)
+		require.NoError(t, err)
+		before := s.store.size
+		_, err = s.Append(want)
+		require.NoError(t, err)
+		sizes = append(sizes, s.store.size-before)
+		for off := uint64(16); off < s.nextOffset; off++ {
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, got.Value)
+		}
+		require.NoError(t, s.Close())
+	}
+	for i := 1; i < len(codecs); i++ {
+		require.Less(t, sizes[i], sizes[0], codecs[i].String())
+	}
+
+	// snapshots stream the store files and decompress the records as they go
+	f, err := os.Open(dir + "/16.store")
+	require.NoError(t, err)
+	defer f.Close()
+	frames := newFrameReader(f)
+	for range codecs {
+		b, err := frames.Next()
+		require.NoError(t, err)
+		got := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b, got))
+		require.Equal(t, want.Value, got.Value)
+	}
+	_, err = frames.Next()
+	require.Equal(t, io.EOF, err)
+}
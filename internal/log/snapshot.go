@@ -1,25 +1,310 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
 	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 	"io"
+	"time"
 )
 
+var (
+	// snapshotMagic starts the header of snapshots that hold topics. Snapshots
+	// from before topics existed are the default log's store files, which start
+	// with a store header or a record's length instead.
+	snapshotMagic = []byte("LHSN")
+)
+
+const (
+	// snapshotVersionTopics snapshots hold a section for each topic, each made of
+	// the topic's name, the log's next offset and its store files.
+	snapshotVersionTopics uint32 = 1
+	// snapshotVersionOffsets snapshots end each topic's section with the offsets
+	// consumer groups committed for the topic.
+	snapshotVersionOffsets uint32 = 2
+	// snapshotVersionGenerations snapshots follow the header with the topics'
+	// version, and each topic's name with its generation.
+	snapshotVersionGenerations uint32 = 3
+	currentSnapshotVersion            = snapshotVersionGenerations
+)
+
+// snapshotProgressInterval is how often Persist logs how far along it is.
+const snapshotProgressInterval = 10 * time.Second
+
+/*
+snapshot is a partition's topics as they were when fsm.Snapshot was called. It
+holds the topics' store files open until Raft releases it, and reads each up to
+where it ended then, so Raft can persist it while records are appended to the
+logs and their segments are compacted or removed.
+*/
 type snapshot struct {
 	reader io.Reader
+	logs   []*logSnapshot
+	// size is the number of bytes in the snapshot
+	size      uint64
+	partition uint32
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
-// Persist is called by Raft to write its state to some sink like in-memory, a file, S3 etc.
-func (s snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+/*
+Persist is called by Raft to write its state to some sink like in-memory, a file,
+S3 etc. It streams the snapshot to the sink, logging how many of its bytes it
+has written every snapshotProgressInterval and once it's done.
+*/
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	logger := zap.L().Named("snapshot").With(
+		zap.Uint32("partition", s.partition),
+		zap.String("id", sink.ID()),
+		zap.Uint64("total_bytes", s.size),
+	)
+	start := time.Now()
+	w := &progressWriter{Writer: sink, logger: logger, reported: start}
+	if _, err := io.Copy(w, s.reader); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
-	return sink.Close()
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	logger.Info("persisted snapshot",
+		zap.Uint64("bytes", w.written),
+		zap.Duration("duration", time.Since(start)),
+	)
+	return nil
+}
+
+// Release is called by Raft when it’s finished taking the snapshot. It closes
+// the store files the snapshot holds open.
+func (s *snapshot) Release() {
+	for _, log := range s.logs {
+		_ = log.Close()
+	}
+}
+
+// progressWriter counts the bytes written through it and logs the count every
+// snapshotProgressInterval.
+type progressWriter struct {
+	io.Writer
+	logger   *zap.Logger
+	written  uint64
+	reported time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	p.written += uint64(n)
+	if time.Since(p.reported) >= snapshotProgressInterval {
+		p.reported = time.Now()
+		p.logger.Info("persisting snapshot", zap.Uint64("bytes", p.written))
+	}
+	return n, err
+}
+
+/*
+newTopicsSnapshot takes a snapshot of every topic. The header is followed by the
+topics' version. Each topic's section starts with the topic's name, its
+generation, the offset its log will give the next record and the size of its
+store files, which follow. The section ends with the number of offsets
+committed for the topic and the offsets, in the format of the offsets file.
+*/
+func newTopicsSnapshot(topics *Topics) (*snapshot, error) {
+	header := make([]byte, headerWidth+8)
+	copy(header, snapshotMagic)
+	enc.PutUint32(header[len(snapshotMagic):], currentSnapshotVersion)
+	topics.mu.Lock()
+	enc.PutUint64(header[headerWidth:], topics.version)
+	topics.mu.Unlock()
+	s := &snapshot{size: uint64(len(header))}
+	readers := []io.Reader{bytes.NewReader(header)}
+	err := topics.each(func(name string, log *Log) error {
+		store, err := log.snapshot()
+		if err != nil {
+			return err
+		}
+		s.logs = append(s.logs, store)
+		var section bytes.Buffer
+		_ = binary.Write(&section, enc, uint32(len(name)))
+		section.WriteString(name)
+		_ = binary.Write(&section, enc, topics.generations[name])
+		_ = binary.Write(&section, enc, store.next)
+		_ = binary.Write(&section, enc, store.size)
+		// each holds the lock, so the offsets can't change under us
+		var offsets bytes.Buffer
+		_ = binary.Write(&offsets, enc, uint32(len(topics.offsets[name])))
+		writeOffsets(&offsets, name, topics.offsets[name])
+		s.size += uint64(section.Len()) + store.size + uint64(offsets.Len())
+		readers = append(readers, &section, store, &offsets)
+		return nil
+	})
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+	s.reader = io.MultiReader(readers...)
+	return s, nil
 }
 
-// Release is called by Raft when it’s finished taking the snapshot
-func (s snapshot) Release() {
+/*
+restoreTopics replaces the topics with the ones in the snapshot. Snapshots taken
+before topics existed only hold the default topic's log.
+*/
+func restoreTopics(topics *Topics, snapshot io.Reader) error {
+	r := bufio.NewReader(snapshot)
+	if err := topics.deleteTopics(); err != nil {
+		return err
+	}
+	header, err := r.Peek(headerWidth)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(header) < headerWidth || !bytes.Equal(header[:len(snapshotMagic)], snapshotMagic) {
+		log, err := topics.Topic(DefaultTopic)
+		if err != nil {
+			return err
+		}
+		return restoreLog(log, r, nil)
+	}
+	version := enc.Uint32(header[len(snapshotMagic):])
+	if version > currentSnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	if _, err = r.Discard(headerWidth); err != nil {
+		return err
+	}
+	if version >= snapshotVersionGenerations {
+		var topicsVersion uint64
+		if err = binary.Read(r, enc, &topicsVersion); err != nil {
+			return unexpectedEOF(err)
+		}
+		topics.mu.Lock()
+		topics.version = topicsVersion
+		err = topics.saveGenerations()
+		topics.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		var nameLen uint32
+		if err = binary.Read(r, enc, &nameLen); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := make([]byte, nameLen)
+		var generation, next, size uint64
+		if _, err = io.ReadFull(r, name); err != nil {
+			return unexpectedEOF(err)
+		}
+		if version >= snapshotVersionGenerations {
+			if err = binary.Read(r, enc, &generation); err != nil {
+				return unexpectedEOF(err)
+			}
+		}
+		if err = binary.Read(r, enc, &next); err != nil {
+			return unexpectedEOF(err)
+		}
+		if err = binary.Read(r, enc, &size); err != nil {
+			return unexpectedEOF(err)
+		}
+		if string(name) != DefaultTopic {
+			topics.mu.Lock()
+			err = topics.createTopic(string(name), generation)
+			topics.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		log, err := topics.Topic(string(name))
+		if err != nil {
+			return err
+		}
+		store := io.LimitReader(r, int64(size))
+		if err = restoreLog(log, store, &next); err != nil {
+			return err
+		}
+		if _, err = io.Copy(io.Discard, store); err != nil {
+			return err
+		}
+		if version < snapshotVersionOffsets {
+			continue
+		}
+		if err = restoreOffsets(topics, string(name), r); err != nil {
+			return err
+		}
+	}
+}
+
+// restoreOffsets replaces the offsets committed for the topic with the ones in
+// the snapshot's section.
+func restoreOffsets(topics *Topics, topic string, r io.Reader) error {
+	var n uint32
+	if err := binary.Read(r, enc, &n); err != nil {
+		return unexpectedEOF(err)
+	}
+	offsets := make(map[string]uint64, n)
+	for i := uint32(0); i < n; i++ {
+		if _, err := readString(r); err != nil {
+			return unexpectedEOF(err)
+		}
+		group, err := readString(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		var offset uint64
+		if err = binary.Read(r, enc, &offset); err != nil {
+			return unexpectedEOF(err)
+		}
+		offsets[group] = offset
+	}
+	topics.mu.Lock()
+	defer topics.mu.Unlock()
+	return topics.setOffsets(topic, offsets)
+}
+
+/*
+restoreLog replaces the log's records with the ones in the store files read
+from r. If there aren't any, the log starts over at next when it's given.
+*/
+func restoreLog(log *Log, r io.Reader, next *uint64) error {
+	frames := newFrameReader(r)
+	for i := 0; ; i++ {
+		b, err := frames.Next()
+		if err == io.EOF {
+			if i == 0 {
+				// an empty log still has to match the leader's next offset
+				if next != nil {
+					log.Config.Segment.InitialOffset = *next
+				}
+				return log.Reset()
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(b, record); err != nil {
+			return err
+		}
+		// The FSM must discard existing state to make sure its state will match the
+		// leader’s replicated state, so we reset the log and configure its initial offset
+		// to the first record’s offset we read from the snapshot so the log’s offsets match.
+		if i == 0 {
+			log.Config.Segment.InitialOffset = record.Offset
+			if err := log.Reset(); err != nil {
+				return err
+			}
+		}
+		// Appending the records one-by-one to our new log, keeping their offsets
+		// in case the log was compacted
+		if _, err = log.appendAt(record); err != nil {
+			return err
+		}
+	}
 }
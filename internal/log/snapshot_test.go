@@ -0,0 +1,83 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshotPersist(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	dir, _ := ioutil.TempDir("", "snapshot-persist-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	topics, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	defer topics.Close()
+	for i := 0; i < 4; i++ {
+		_, err = topics.Append(DefaultTopic, &api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+
+	snap, err := newTopicsSnapshot(topics)
+	require.NoError(t, err)
+	defer snap.Release()
+	// records appended after the snapshot is taken aren't in it, and segments
+	// removed meanwhile still are
+	for i := 4; i < 6; i++ {
+		_, err = topics.Append(DefaultTopic, &api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	log, err := topics.Topic(DefaultTopic)
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(2))
+
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+	require.True(t, sink.closed)
+	require.Equal(t, snap.size, uint64(sink.Len()))
+	persisted := logs.FilterMessage("persisted snapshot").All()
+	require.Equal(t, 1, len(persisted))
+	require.Equal(t, snap.size, persisted[0].ContextMap()["bytes"])
+
+	dir, _ = ioutil.TempDir("", "snapshot-restore-test")
+	defer os.RemoveAll(dir)
+	restored, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restoreTopics(restored, &sink.Buffer))
+	records, err := restored.ReadRange(DefaultTopic, 0, 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(records))
+	for i, record := range records {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprint(i)), record.Value)
+	}
+}
+
+// snapshotSink is a raft.SnapshotSink that keeps the snapshot in memory.
+type snapshotSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *snapshotSink) ID() string {
+	return "test"
+}
+
+func (s *snapshotSink) Cancel() error {
+	return nil
+}
+
+func (s *snapshotSink) Close() error {
+	s.closed = true
+	return nil
+}
@@ -2,7 +2,12 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 )
@@ -10,18 +15,50 @@ import (
 var (
 	enc = binary.BigEndian // enc defines the encoding that we persist record
 	// sizes and index entries in
+
+	// storeMagic prefixes the header of every store file written in a versioned
+	// format. Legacy store files start directly with a record's length, which can
+	// never be this large, so the two layouts can't be confused.
+	storeMagic = []byte("LHST")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errCorruptFrame is returned when a frame in the store can't be trusted,
+	// either because its checksum doesn't match or because it runs past the end
+	// of the file.
+	errCorruptFrame = errors.New("corrupt store frame")
 )
 
 const (
 	lenWidth = 8 //  lenWidth defines the number of bytes used to store the
 	// record’s length.
+	crcWidth    = 4 // crcWidth is the number of bytes used to store a record's checksum
+	codecWidth  = 1 // codecWidth is the number of bytes used to store a record's codec
+	headerWidth = 8 // headerWidth is the size of the magic and version at the start of a store
+)
+
+// Store format versions. A store's version is written once in its header and
+// decides how each frame in the file is laid out.
+const (
+	// storeVersionLegacy frames are the record's length followed by the record.
+	storeVersionLegacy uint32 = 0
+	// storeVersionCRC frames are the record's length, a CRC32-C of the record and
+	// then the record.
+	storeVersionCRC uint32 = 1
+	// storeVersionCodec frames are the record's length, a CRC32-C of the codec
+	// and the record, the codec the record was compressed with and then the
+	// compressed record.
+	storeVersionCodec uint32 = 2
+
+	currentStoreVersion = storeVersionCodec
 )
 
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	mu      sync.Mutex
+	buf     *bufio.Writer
+	size    uint64
+	version uint32
 }
 
 /*
@@ -29,69 +66,144 @@ The newStore(*os.File) function creates a
 store for the given file. The function calls os.Stat(name string) to get the file’s
 current size, in case we’re re-creating the store from a file that has existing
 data, which would happen if, for example, our service had restarted.
+
+A new store gets a header with the current format version. An existing store
+keeps the version it was written with, and files without a header are read as
+legacy stores.
 */
 func newStore(f *os.File) (*store, error) {
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
-		size: size,
+		size: uint64(fi.Size()),
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+	if s.size >= headerWidth {
+		if s.version, err = readStoreVersion(f); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	// Anything shorter than a header can't hold a whole record, so it's what's
+	// left of a store whose creation was interrupted.
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(storeHeader(currentStoreVersion)); err != nil {
+		return nil, err
+	}
+	s.size = headerWidth
+	s.version = currentStoreVersion
+	return s, nil
+}
+
+// readStoreVersion returns the version of the store in f, which holds at least
+// a header's worth of bytes.
+func readStoreVersion(f *os.File) (uint32, error) {
+	header := make([]byte, headerWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	version, ok := parseStoreHeader(header)
+	if !ok {
+		return storeVersionLegacy, nil
+	}
+	if version > currentStoreVersion {
+		return 0, fmt.Errorf("%s: unsupported store version %d", f.Name(), version)
+	}
+	return version, nil
 }
 
 /*
-Append persists the given bytes to the store. We write the length of the
-record so that, when we read the record, we know how many bytes to read.
+Append persists the given bytes, compressed with codec, to the store. We write
+the length of the record so that, when we read the record, we know how many
+bytes to read, and for versioned stores a checksum so that we can tell when the
+bytes we read back aren't the ones we wrote. Stores older than
+storeVersionCodec have nowhere to record the codec and only take CodecNone.
 
 We write to the buffered writer instead of directly to the file to reduce the
 number of system calls and improve performance. Then we return the number of bytes
 written and the position where the store holds the record in its file. The segment
 will use this position when it creates an associated index entry for this record.
 */
-func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+func (s *store) Append(p []byte, codec Codec) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if codec != CodecNone && s.version < storeVersionCodec {
+		return 0, 0, fmt.Errorf("%s: store version %d can't hold %s records",
+			s.Name(), s.version, codec)
+	}
 	pos = s.size
 	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
 	}
-	w, err := s.buf.Write(p)
+	w := lenWidth
+	if s.version >= storeVersionCRC {
+		if err := binary.Write(s.buf, enc, checksum(s.version, codec, p)); err != nil {
+			return 0, 0, err
+		}
+		w += crcWidth
+	}
+	if s.version >= storeVersionCodec {
+		if err := s.buf.WriteByte(byte(codec)); err != nil {
+			return 0, 0, err
+		}
+		w += codecWidth
+	}
+	pw, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += pw
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
 /*
-Read returns the record stored at the given position.
+Read returns the record stored at the given position, as it was appended, and
+the codec it was compressed with. It returns errCorruptFrame if the frame
+doesn't fit in the file or its checksum doesn't match the record.
 */
-func (s *store) Read(pos uint64) ([]byte, error) {
+func (s *store) Read(pos uint64) ([]byte, Codec, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	/* First flush the writer buffer, in case we’re about to try to read a record
 	that the buffer hasn’t flushed to disk yet. */
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Next, find out how many bytes we have to read to get
 	// the whole record, and then we fetch and return the record.
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	overhead := frameOverhead(s.version)
+	if pos+overhead > s.size {
+		return nil, 0, fmt.Errorf("%w: frame at %d is past the end of the store",
+			errCorruptFrame, pos)
 	}
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	meta := make([]byte, overhead)
+	if _, err := s.File.ReadAt(meta, int64(pos)); err != nil {
+		return nil, 0, err
 	}
-	return b, nil
+	size := enc.Uint64(meta[:lenWidth])
+	if size > s.size-pos-overhead {
+		return nil, 0, fmt.Errorf("%w: record at %d has length %d beyond the end of the store",
+			errCorruptFrame, pos, size)
+	}
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(pos+overhead)); err != nil {
+		return nil, 0, err
+	}
+	codec := frameCodec(s.version, meta)
+	if s.version >= storeVersionCRC {
+		if err := verifyChecksum(s.version, codec, b, enc.Uint32(meta[lenWidth:])); err != nil {
+			return nil, 0, fmt.Errorf("%w at %d", err, pos)
+		}
+	}
+	return b, codec, nil
 }
 
 /*
@@ -107,6 +219,83 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Flush writes the buffered records to the store's file without syncing it.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+/*
+Sync flushes the buffered writer and commits the store's file to stable storage.
+*/
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// dataStart returns the position of the first frame in the store.
+func (s *store) dataStart() uint64 {
+	if s.version == storeVersionLegacy {
+		return 0
+	}
+	return headerWidth
+}
+
+/*
+frameEnd returns the position just past the frame stored at pos. It fails the
+same way Read does if the frame is incomplete or doesn't match its checksum.
+*/
+func (s *store) frameEnd(pos uint64) (uint64, error) {
+	b, _, err := s.Read(pos)
+	if err != nil {
+		return 0, err
+	}
+	return pos + frameOverhead(s.version) + uint64(len(b)), nil
+}
+
+/*
+frameSpan returns the position just past the frame stored at pos, going by its
+length alone. whole is false if the frame runs past the end of the store, as a
+torn write leaves it.
+*/
+func (s *store) frameSpan(pos uint64) (end uint64, whole bool, err error) {
+	overhead := frameOverhead(s.version)
+	if pos+overhead > s.size {
+		return 0, false, nil
+	}
+	meta := make([]byte, lenWidth)
+	if _, err = s.ReadAt(meta, int64(pos)); err != nil {
+		return 0, false, err
+	}
+	size := enc.Uint64(meta)
+	if size > s.size-pos-overhead {
+		return 0, false, nil
+	}
+	return pos + overhead + size, true, nil
+}
+
+/*
+truncate drops everything in the store from size onwards. It's used to cut off
+a record that was only partially written when the process died.
+*/
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
 /*
 Close persists any buffered data before closing the file.
 */
@@ -119,3 +308,116 @@ func (s *store) Close() error {
 	}
 	return s.File.Close()
 }
+
+// storeHeader returns the header written at the start of a store of the given
+// version.
+func storeHeader(version uint32) []byte {
+	header := make([]byte, headerWidth)
+	copy(header, storeMagic)
+	enc.PutUint32(header[len(storeMagic):], version)
+	return header
+}
+
+// parseStoreHeader returns the version held in b if b is a store header.
+func parseStoreHeader(b []byte) (uint32, bool) {
+	if len(b) < headerWidth || !bytes.Equal(b[:len(storeMagic)], storeMagic) {
+		return 0, false
+	}
+	return enc.Uint32(b[len(storeMagic):headerWidth]), true
+}
+
+// frameOverhead returns the number of bytes a store of the given version writes
+// in front of each record.
+func frameOverhead(version uint32) uint64 {
+	switch {
+	case version >= storeVersionCodec:
+		return lenWidth + crcWidth + codecWidth
+	case version >= storeVersionCRC:
+		return lenWidth + crcWidth
+	}
+	return lenWidth
+}
+
+// frameCodec returns the codec held in a frame's overhead bytes. Frames from
+// before storeVersionCodec are never compressed.
+func frameCodec(version uint32, meta []byte) Codec {
+	if version < storeVersionCodec {
+		return CodecNone
+	}
+	return Codec(meta[lenWidth+crcWidth])
+}
+
+// checksum returns the checksum a store of the given version writes for a
+// record. From storeVersionCodec on, it covers the codec too.
+func checksum(version uint32, codec Codec, p []byte) uint32 {
+	var crc uint32
+	if version >= storeVersionCodec {
+		crc = crc32.Update(crc, crcTable, []byte{byte(codec)})
+	}
+	return crc32.Update(crc, crcTable, p)
+}
+
+func verifyChecksum(version uint32, codec Codec, p []byte, want uint32) error {
+	if got := checksum(version, codec, p); got != want {
+		return fmt.Errorf("%w: checksum %08x, want %08x", errCorruptFrame, got, want)
+	}
+	return nil
+}
+
+/*
+frameReader reads records out of a stream of concatenated store files, such as
+the one returned by Log.Reader. Every store header in the stream switches the
+frame layout used for the records that follow it; records before the first
+header are read as legacy frames. Compressed records are decompressed.
+*/
+type frameReader struct {
+	r       io.Reader
+	version uint32
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r, version: storeVersionLegacy}
+}
+
+// Next returns the next record in the stream, or io.EOF once the stream ends
+// on a frame boundary.
+func (f *frameReader) Next() ([]byte, error) {
+	b := make([]byte, lenWidth)
+	for {
+		if _, err := io.ReadFull(f.r, b); err != nil {
+			return nil, err
+		}
+		version, ok := parseStoreHeader(b)
+		if !ok {
+			break
+		}
+		f.version = version
+	}
+	size := enc.Uint64(b)
+	meta := make([]byte, frameOverhead(f.version))
+	copy(meta, b)
+	if _, err := io.ReadFull(f.r, meta[lenWidth:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, f.r, int64(size)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	codec := frameCodec(f.version, meta)
+	if f.version >= storeVersionCRC {
+		err := verifyChecksum(f.version, codec, buf.Bytes(), enc.Uint32(meta[lenWidth:]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decompress(codec, buf.Bytes())
+}
+
+// unexpectedEOF turns an io.EOF in the middle of a frame into io.ErrUnexpectedEOF
+// so callers don't mistake a torn frame for the end of the stream.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
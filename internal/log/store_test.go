@@ -1,7 +1,9 @@
 package log
 
 import (
+	"encoding/binary"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -9,7 +11,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth + codecWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -32,41 +34,144 @@ func TestStoreAppendRead(t *testing.T) {
 func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	for i := uint64(1); i < 4; i++ {
-		n, pos, err := s.Append(write)
+		n, pos, err := s.Append(write, CodecNone)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*i)
+		require.Equal(t, pos+n, headerWidth+width*i)
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := uint64(headerWidth)
 	for i := uint64(1); i < 4; i++ {
-		read, err := s.Read(pos)
+		read, codec, err := s.Read(pos)
 		require.NoError(t, err)
 		require.Equal(t, write, read)
+		require.Equal(t, CodecNone, codec)
 		pos += width
 	}
 }
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
-	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+	b := make([]byte, headerWidth)
+	n, err := s.ReadAt(b, 0)
+	require.NoError(t, err)
+	version, ok := parseStoreHeader(b)
+	require.True(t, ok)
+	require.Equal(t, currentStoreVersion, version)
+	for i, off := uint64(1), int64(n); i < 4; i++ {
+		b := make([]byte, lenWidth+crcWidth+codecWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, lenWidth+crcWidth+codecWidth, n)
 		off += int64(n)
 
 		size := enc.Uint64(b)
+		crc := enc.Uint32(b[lenWidth:])
+		require.Equal(t, byte(CodecNone), b[lenWidth+crcWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
 		require.Equal(t, write, b)
+		require.Equal(t, checksum(currentStoreVersion, CodecNone, write), crc)
 		require.Equal(t, int(size), n)
 		off += int64(n)
 	}
 }
 
+func TestStoreCorruptRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_record_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write, CodecNone)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// flip a bit in the record's value
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{write[0] ^ 1}, int64(pos+lenWidth+crcWidth+codecWidth))
+	require.NoError(t, err)
+
+	s, err = newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Read(pos)
+	require.ErrorIs(t, err, errCorruptFrame)
+	// a position past the end of the store is corrupt too
+	_, _, err = s.Read(s.size)
+	require.ErrorIs(t, err, errCorruptFrame)
+}
+
+func TestStoreLegacyFormat(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_legacy_format_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// write frames the way stores did before they had a header
+	for i := 0; i < 3; i++ {
+		require.NoError(t, binary.Write(f, enc, uint64(len(write))))
+		_, err = f.Write(write)
+		require.NoError(t, err)
+	}
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, storeVersionLegacy, s.version)
+	var pos uint64
+	for i := 0; i < 3; i++ {
+		read, _, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+		pos += uint64(len(write)) + lenWidth
+	}
+	n, pos, err := s.Append(write, CodecNone)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(write))+lenWidth, n)
+	read, _, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	// legacy frames have nowhere to record a codec
+	_, _, err = s.Append(write, CodecGzip)
+	require.Error(t, err)
+}
+
+func TestStoreCRCFormat(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_crc_format_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// write frames the way stores did before records had a codec
+	_, err = f.Write(storeHeader(storeVersionCRC))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, binary.Write(f, enc, uint64(len(write))))
+		require.NoError(t, binary.Write(f, enc, crc32.Checksum(write, crcTable)))
+		_, err = f.Write(write)
+		require.NoError(t, err)
+	}
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, storeVersionCRC, s.version)
+	pos := uint64(headerWidth)
+	for i := 0; i < 3; i++ {
+		read, codec, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+		require.Equal(t, CodecNone, codec)
+		pos += uint64(len(write)) + lenWidth + crcWidth
+	}
+	n, pos, err := s.Append(write, CodecNone)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(write))+lenWidth+crcWidth, n)
+	read, _, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -74,7 +179,7 @@ func TestStoreClose(t *testing.T) {
 	s, err := newStore(f)
 
 	require.NoError(t, err)
-	_, _, err = s.Append(write)
+	_, _, err = s.Append(write, CodecNone)
 	require.NoError(t, err)
 	f, beforeSize, err := openFile(f.Name())
 	require.NoError(t, err)
@@ -0,0 +1,127 @@
+package log
+
+import (
+	"os"
+	"sort"
+)
+
+var (
+	tsWidth    uint64 = 8
+	tsOffWidth uint64 = 4
+	tsEntWidth        = tsWidth + tsOffWidth
+)
+
+/*
+timeIndex is a sparse index from append time to offset. Each entry holds the
+largest timestamp appended to the segment so far and the relative offset of the
+record that was appended when the entry was written, so every record at or
+before an entry's offset has a timestamp no later than the entry's.
+
+Entries are few, so we keep them in memory for lookups and only append to the
+file.
+*/
+type timeIndex struct {
+	file    *os.File
+	entries []timeIndexEntry
+}
+
+type timeIndexEntry struct {
+	timestamp int64
+	off       uint32
+}
+
+/*
+newTimeIndex loads the entries in the given file. A partial entry at the end of
+the file, left by an unclean shutdown, is cut off.
+*/
+func newTimeIndex(f *os.File) (*timeIndex, error) {
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	size := nearestMultiple(uint64(fi.Size()), tsEntWidth)
+	if size != uint64(fi.Size()) {
+		if err = f.Truncate(int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]byte, size)
+	if _, err = f.ReadAt(b, 0); err != nil && size > 0 {
+		return nil, err
+	}
+	t := &timeIndex{file: f}
+	for pos := uint64(0); pos < size; pos += tsEntWidth {
+		t.entries = append(t.entries, timeIndexEntry{
+			timestamp: int64(enc.Uint64(b[pos : pos+tsWidth])),
+			off:       enc.Uint32(b[pos+tsWidth : pos+tsEntWidth]),
+		})
+	}
+	return t, nil
+}
+
+// Write appends an entry to the time index.
+func (t *timeIndex) Write(timestamp int64, off uint32) error {
+	b := make([]byte, tsEntWidth)
+	enc.PutUint64(b[:tsWidth], uint64(timestamp))
+	enc.PutUint32(b[tsWidth:], off)
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeIndexEntry{timestamp: timestamp, off: off})
+	return nil
+}
+
+/*
+Lookup returns the relative offset to start scanning from to find the first
+record appended at or after timestamp. Every record before the returned offset
+is older than timestamp.
+*/
+func (t *timeIndex) Lookup(timestamp int64) uint32 {
+	// entries are sorted by timestamp, find the first one that isn't older
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return 0
+	}
+	return t.entries[i-1].off + 1
+}
+
+// Last returns the most recent entry.
+func (t *timeIndex) Last() (timeIndexEntry, bool) {
+	if len(t.entries) == 0 {
+		return timeIndexEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+/*
+TruncateAfter drops the entries for relative offsets at or past off, which
+segment recovery may have removed from the store.
+*/
+func (t *timeIndex) TruncateAfter(off uint32) error {
+	n := len(t.entries)
+	for n > 0 && t.entries[n-1].off >= off {
+		n--
+	}
+	if n == len(t.entries) {
+		return nil
+	}
+	if err := t.file.Truncate(int64(uint64(n) * tsEntWidth)); err != nil {
+		return err
+	}
+	t.entries = t.entries[:n]
+	return nil
+}
+
+func (t *timeIndex) Sync() error {
+	return t.file.Sync()
+}
+
+func (t *timeIndex) Close() error {
+	return t.file.Close()
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
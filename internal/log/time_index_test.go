@@ -0,0 +1,52 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "time_index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	_, ok := idx.Last()
+	require.False(t, ok)
+	require.Equal(t, uint32(0), idx.Lookup(100))
+
+	entries := []timeIndexEntry{
+		{timestamp: 10, off: 0},
+		{timestamp: 20, off: 4},
+		{timestamp: 30, off: 9},
+	}
+	for _, e := range entries {
+		require.NoError(t, idx.Write(e.timestamp, e.off))
+	}
+	// lookups start right after the last entry that's older than the timestamp
+	require.Equal(t, uint32(0), idx.Lookup(10))
+	require.Equal(t, uint32(1), idx.Lookup(15))
+	require.Equal(t, uint32(5), idx.Lookup(21))
+	require.Equal(t, uint32(10), idx.Lookup(31))
+	require.NoError(t, idx.Close())
+
+	// a partial entry at the end of the file is dropped when it's reopened
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, entries, idx.entries)
+
+	require.NoError(t, idx.TruncateAfter(9))
+	last, ok := idx.Last()
+	require.True(t, ok)
+	require.Equal(t, entries[1], last)
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(2*tsEntWidth), fi.Size())
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,401 @@
+package log
+
+import (
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// DefaultTopic is the topic that requests without a topic go to. It always
+// exists and can't be deleted.
+const DefaultTopic = ""
+
+// topicName is what a topic's name, which is also its directory's name, may
+// look like.
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+func validTopic(name string) bool {
+	return topicName.MatchString(name) && name != "." && name != ".."
+}
+
+/*
+Topics manages a set of named logs in one directory. The default topic lives in
+<dir>/log, where the log lived before topics existed, and every other topic in
+<dir>/topics/<name>.
+
+A topic's log is opened the first time it's used, so a server with many topics
+only keeps the ones in use open. DistributedLog replicates the changes to its
+Topics through Raft; on its own, Topics is a local, non-replicated store that
+the gRPC server can use directly.
+*/
+type Topics struct {
+	mu     sync.Mutex
+	Dir    string
+	Config Config
+	logs   map[string]*Log
+	// offsets holds the offsets committed by each consumer group for each topic.
+	offsets map[string]map[string]uint64
+	// generations holds the generation of each topic, and version the highest
+	// generation or deletion applied, as generations.go describes.
+	generations map[string]uint64
+	version     uint64
+}
+
+func NewTopics(dir string, c Config) (*Topics, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "topics"), 0755); err != nil {
+		return nil, err
+	}
+	logDir := filepath.Join(dir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+	log, err := NewLog(logDir, c)
+	if err != nil {
+		return nil, err
+	}
+	t := &Topics{
+		Dir:    dir,
+		Config: c,
+		logs:   map[string]*Log{DefaultTopic: log},
+	}
+	if err = t.loadOffsets(); err != nil {
+		return nil, err
+	}
+	if err = t.loadGenerations(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Topic returns the log of the given topic, opening it if it isn't open yet.
+func (t *Topics) Topic(name string) (*Log, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.topic(name)
+}
+
+// topic returns the log of the given topic. The caller must hold the lock.
+func (t *Topics) topic(name string) (*Log, error) {
+	if log, ok := t.logs[name]; ok {
+		return log, nil
+	}
+	if !validTopic(name) {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	dir := t.topicDir(name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	} else if err != nil {
+		return nil, err
+	}
+	log, err := NewLog(dir, t.Config)
+	if err != nil {
+		return nil, err
+	}
+	t.logs[name] = log
+	return log, nil
+}
+
+func (t *Topics) topicDir(name string) string {
+	if name == DefaultTopic {
+		return filepath.Join(t.Dir, "log")
+	}
+	return filepath.Join(t.Dir, "topics", name)
+}
+
+// CreateTopic creates a topic with an empty log, as the topics' next version.
+func (t *Topics) CreateTopic(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.createTopic(name, t.version+1)
+}
+
+/*
+createTopic creates a topic of the given generation. The generation is recorded
+before the topic's directory is made, so a crash in between leaves no topic,
+which a replicated topic's Raft entry creates again when it's replayed. The
+caller must hold the lock.
+*/
+func (t *Topics) createTopic(name string, generation uint64) error {
+	if name == DefaultTopic {
+		return api.ErrTopicExists{Topic: name}
+	}
+	if !validTopic(name) {
+		return api.ErrInvalidTopic{Topic: name}
+	}
+	dir := t.topicDir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return api.ErrTopicExists{Topic: name}
+	}
+	t.generations[name] = generation
+	if generation > t.version {
+		t.version = generation
+	}
+	if err := t.saveGenerations(); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	log, err := NewLog(dir, t.Config)
+	if err != nil {
+		return err
+	}
+	t.logs[name] = log
+	return nil
+}
+
+// DeleteTopic closes the topic's log and removes its data, along with the
+// offsets committed for it. Readers waiting on the topic are woken up with an
+// error.
+func (t *Topics) DeleteTopic(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.deleteTopic(name, t.version+1)
+}
+
+/*
+deleteTopic deletes the topic, raising the version to index. The topic's
+generation is dropped before its data, so a crash in between leaves the topic
+as generation 0 until its Raft entry deletes it again. The caller must hold the
+lock.
+*/
+func (t *Topics) deleteTopic(name string, index uint64) error {
+	if name == DefaultTopic {
+		return api.ErrInvalidTopic{Topic: name}
+	}
+	log, err := t.topic(name)
+	if err != nil {
+		return err
+	}
+	delete(t.generations, name)
+	if index > t.version {
+		t.version = index
+	}
+	if err = t.saveGenerations(); err != nil {
+		return err
+	}
+	delete(t.logs, name)
+	if err = log.Remove(); err != nil {
+		return err
+	}
+	if _, ok := t.offsets[name]; !ok {
+		return nil
+	}
+	return t.setOffsets(name, nil)
+}
+
+/*
+topicAt returns the log of the given generation of the topic, for a partition
+other than 0. The topic is created when the topics don't have it, and replaces
+an older generation of it, whose deletion partition 0 applied when this
+partition's group got the write. It's not found when the topics have a newer
+generation.
+*/
+func (t *Topics) topicAt(name string, generation uint64) (*Log, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	log, err := t.topic(name)
+	if _, ok := err.(api.ErrTopicNotFound); ok {
+		if err = t.createTopic(name, generation); err != nil {
+			return nil, err
+		}
+		return t.topic(name)
+	}
+	if err != nil || name == DefaultTopic {
+		return log, err
+	}
+	switch current := t.generations[name]; {
+	case current == generation:
+		return log, nil
+	case current > generation:
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	if err = t.deleteTopic(name, generation); err != nil {
+		return nil, err
+	}
+	if err = t.createTopic(name, generation); err != nil {
+		return nil, err
+	}
+	return t.topic(name)
+}
+
+// deleteBefore deletes the topic, as deleteTopic does, unless it's missing or
+// of a generation created at or after index.
+func (t *Topics) deleteBefore(name string, index uint64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.topic(name); err != nil {
+		if _, ok := err.(api.ErrTopicNotFound); ok {
+			return nil
+		}
+		return err
+	}
+	if t.generations[name] >= index {
+		return nil
+	}
+	return t.deleteTopic(name, index)
+}
+
+// ListTopics returns the names of the topics in order. The default topic isn't
+// listed.
+func (t *Topics) ListTopics() ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.names()
+}
+
+// names returns the names of the topics on disk in order. The caller must hold
+// the lock.
+func (t *Topics) names() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(t.Dir, "topics"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if file.IsDir() && validTopic(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t *Topics) Append(topic string, record *api.Record) (uint64, error) {
+	log, err := t.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return log.Append(record)
+}
+
+func (t *Topics) AppendBatch(topic string, records []*api.Record) (uint64, error) {
+	log, err := t.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return log.AppendBatch(records)
+}
+
+func (t *Topics) Read(topic string, off uint64) (*api.Record, error) {
+	log, err := t.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return log.Read(off)
+}
+
+func (t *Topics) ReadRange(topic string, from, maxRecords, maxBytes uint64) (
+	[]*api.Record, error) {
+	log, err := t.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return log.ReadRange(from, maxRecords, maxBytes)
+}
+
+func (t *Topics) OffsetForTime(topic string, timestamp int64) (uint64, error) {
+	log, err := t.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return log.OffsetForTime(timestamp)
+}
+
+func (t *Topics) WaitForOffset(ctx context.Context, topic string, off uint64) error {
+	log, err := t.Topic(topic)
+	if err != nil {
+		return err
+	}
+	if err = log.WaitForOffset(ctx, off); err == errLogClosed {
+		// the topic was deleted while we waited
+		return api.ErrTopicNotFound{Topic: topic}
+	}
+	return err
+}
+
+// each calls fn with every topic's log, opening the ones that aren't open, in
+// order of the topics' names, starting with the default topic.
+func (t *Topics) each(fn func(name string, log *Log) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names, err := t.names()
+	if err != nil {
+		return err
+	}
+	for _, name := range append([]string{DefaultTopic}, names...) {
+		log, err := t.topic(name)
+		if err != nil {
+			return err
+		}
+		if err = fn(name, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTopics deletes every topic but the default one, which restoring a
+// snapshot replaces, along with every committed offset and generation.
+func (t *Topics) deleteTopics() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, log := range t.logs {
+		if name == DefaultTopic {
+			continue
+		}
+		if err := log.Close(); err != nil {
+			return err
+		}
+		delete(t.logs, name)
+	}
+	dir := filepath.Join(t.Dir, "topics")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	t.offsets = make(map[string]map[string]uint64)
+	if err := t.saveOffsets(); err != nil {
+		return err
+	}
+	t.generations = make(map[string]uint64)
+	t.version = 0
+	return t.saveGenerations()
+}
+
+// Close closes every open topic's log.
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, log := range t.logs {
+		if err := log.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove closes the topics and removes their data.
+func (t *Topics) Remove() error {
+	if err := t.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(t.Dir, "topics")); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(t.offsetsPath()); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(t.generationsPath()); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(t.Dir, "log"))
+}
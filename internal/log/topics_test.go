@@ -0,0 +1,195 @@
+package log
+
+import (
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTopics(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, topics *Topics,
+	){
+		"create, list and delete topics":        testCreateDeleteTopics,
+		"invalid topic names":                   testInvalidTopics,
+		"topics are kept apart":                 testTopicsApart,
+		"topics are reopened":                   testReopenTopics,
+		"deleting a topic wakes up its readers": testDeleteTopicWakesReaders,
+		"snapshot and restore topics":           testSnapshotRestoreTopics,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "topics-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			topics, err := NewTopics(dir, c)
+			require.NoError(t, err)
+			defer topics.Close()
+			fn(t, topics)
+		})
+	}
+}
+
+func testCreateDeleteTopics(t *testing.T, topics *Topics) {
+	names, err := topics.ListTopics()
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	require.NoError(t, topics.CreateTopic("orders"))
+	require.NoError(t, topics.CreateTopic("events"))
+	err = topics.CreateTopic("orders")
+	require.Equal(t, api.ErrTopicExists{Topic: "orders"}, err)
+	err = topics.CreateTopic(DefaultTopic)
+	require.Equal(t, api.ErrTopicExists{Topic: DefaultTopic}, err)
+
+	names, err = topics.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"events", "orders"}, names)
+
+	require.NoError(t, topics.DeleteTopic("orders"))
+	err = topics.DeleteTopic("orders")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+	_, err = topics.Append("orders", &api.Record{Value: []byte("lost")})
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+	names, err = topics.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"events"}, names)
+
+	// a deleted topic can be created again, and starts over empty
+	require.NoError(t, topics.CreateTopic("orders"))
+	off, err := topics.Append("orders", &api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testInvalidTopics(t *testing.T, topics *Topics) {
+	for _, name := range []string{".", "..", "a/b", "../log", "with space"} {
+		err := topics.CreateTopic(name)
+		require.Equal(t, api.ErrInvalidTopic{Topic: name}, err)
+		_, err = topics.Read(name, 0)
+		require.Equal(t, api.ErrTopicNotFound{Topic: name}, err)
+	}
+	err := topics.DeleteTopic(DefaultTopic)
+	require.Equal(t, api.ErrInvalidTopic{Topic: DefaultTopic}, err)
+}
+
+func testTopicsApart(t *testing.T, topics *Topics) {
+	require.NoError(t, topics.CreateTopic("orders"))
+	for i := 0; i < 3; i++ {
+		_, err := topics.Append(DefaultTopic, &api.Record{Value: []byte("default")})
+		require.NoError(t, err)
+	}
+	first, err := topics.AppendBatch("orders", []*api.Record{
+		{Value: []byte("order 0")},
+		{Value: []byte("order 1")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+
+	read, err := topics.Read("orders", 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 1"), read.Value)
+	records, err := topics.ReadRange(DefaultTopic, 0, 10, 1<<20)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	_, err = topics.Read("orders", 2)
+	require.Error(t, err)
+}
+
+func testReopenTopics(t *testing.T, topics *Topics) {
+	require.NoError(t, topics.CreateTopic("orders"))
+	_, err := topics.Append("orders", &api.Record{Value: []byte("order")})
+	require.NoError(t, err)
+	require.NoError(t, topics.Close())
+
+	topics, err = NewTopics(topics.Dir, topics.Config)
+	require.NoError(t, err)
+	defer topics.Close()
+	// topics are opened when they're first used
+	require.Len(t, topics.logs, 1)
+	read, err := topics.Read("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), read.Value)
+	names, err := topics.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, names)
+	require.Equal(t, map[string]uint64{"orders": 1}, topics.generations)
+}
+
+func testDeleteTopicWakesReaders(t *testing.T, topics *Topics) {
+	require.NoError(t, topics.CreateTopic("orders"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error)
+	go func() {
+		errs <- topics.WaitForOffset(ctx, "orders", 0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, topics.DeleteTopic("orders"))
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, <-errs)
+}
+
+func testSnapshotRestoreTopics(t *testing.T, topics *Topics) {
+	require.NoError(t, topics.CreateTopic("orders"))
+	require.NoError(t, topics.CreateTopic("empty"))
+	for i := 0; i < 3; i++ {
+		_, err := topics.Append(DefaultTopic, &api.Record{Value: []byte("default")})
+		require.NoError(t, err)
+		_, err = topics.Append("orders", &api.Record{Value: []byte("order")})
+		require.NoError(t, err)
+	}
+	// an empty topic still remembers where its next record goes
+	log, err := topics.Topic("empty")
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("gone")})
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, topics.CommitOffset("billing", "orders", 2))
+	require.NoError(t, topics.CommitOffset("billing", DefaultTopic, 1))
+
+	snap, err := newTopicsSnapshot(topics)
+	require.NoError(t, err)
+	defer snap.Release()
+	dir, err := ioutil.TempDir("", "topics-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restored, err := NewTopics(dir, topics.Config)
+	require.NoError(t, err)
+	defer restored.Close()
+	// topics and offsets that aren't in the snapshot are dropped
+	require.NoError(t, restored.CreateTopic("stale"))
+	require.NoError(t, restored.CommitOffset("shipping", DefaultTopic, 3))
+	require.NoError(t, restoreTopics(restored, snap.reader))
+
+	names, err := restored.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"empty", "orders"}, names)
+	// the topics keep their generations
+	require.Equal(t, topics.generations, restored.generations)
+	require.Equal(t, topics.version, restored.version)
+	for _, name := range []string{DefaultTopic, "orders"} {
+		records, err := restored.ReadRange(name, 0, 10, 1<<20)
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+	}
+	off, err := restored.Append("empty", &api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	off, committed, err := restored.FetchOffset("billing", "orders")
+	require.NoError(t, err)
+	require.True(t, committed)
+	require.Equal(t, uint64(2), off)
+	off, committed, err = restored.FetchOffset("billing", DefaultTopic)
+	require.NoError(t, err)
+	require.True(t, committed)
+	require.Equal(t, uint64(1), off)
+	_, committed, err = restored.FetchOffset("shipping", DefaultTopic)
+	require.NoError(t, err)
+	require.False(t, committed)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+// RaftAdmin administers the Raft groups that replicate the partitions of a
+// CommitLog. Changes have to be made on the group's leader.
+type RaftAdmin interface {
+	TransferLeadership(partition uint32, id string) error
+	RemoveServer(partition uint32, id string) error
+	AddServer(partition uint32, id, addr string, voter bool) error
+	RaftConfiguration(partition uint32) ([]*api.RaftServer, error)
+	RaftStatus(partition uint32) (*api.RaftStatus, error)
+	Snapshot(partition uint32) error
+}
+
+// raftStatusTimeout bounds how long ListRaftConfiguration waits for each
+// server's status, so that a server that's down doesn't hold up the others.
+const raftStatusTimeout = 5 * time.Second
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+/*
+adminServer implements the Admin service, which operators use to manage the
+Raft groups beyond what Serf's membership events do, such as moving leadership
+off servers during rolling upgrades. Every RPC requires the admin action.
+*/
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+func (s *adminServer) TransferLeadership(ctx context.Context,
+	req *api.TransferLeadershipRequest) (*api.TransferLeadershipResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	err := s.onLeaders(ctx, req.Partitions,
+		func(p uint32) error {
+			return s.RaftAdmin.TransferLeadership(p, req.Id)
+		},
+		func(ctx context.Context, leader api.AdminClient, p uint32) error {
+			_, err := leader.TransferLeadership(ctx, &api.TransferLeadershipRequest{
+				Partitions: []uint32{p},
+				Id:         req.Id,
+			})
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.TransferLeadershipResponse{}, nil
+}
+
+func (s *adminServer) RemoveServer(ctx context.Context, req *api.RemoveServerRequest) (
+	*api.RemoveServerResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if req.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "server id is required")
+	}
+	err := s.onLeaders(ctx, req.Partitions,
+		func(p uint32) error {
+			return s.RaftAdmin.RemoveServer(p, req.Id)
+		},
+		func(ctx context.Context, leader api.AdminClient, p uint32) error {
+			_, err := leader.RemoveServer(ctx, &api.RemoveServerRequest{
+				Partitions: []uint32{p},
+				Id:         req.Id,
+			})
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RemoveServerResponse{}, nil
+}
+
+func (s *adminServer) AddVoter(ctx context.Context, req *api.AddServerRequest) (
+	*api.AddServerResponse, error) {
+	return s.addServer(ctx, req, true)
+}
+
+func (s *adminServer) AddNonvoter(ctx context.Context, req *api.AddServerRequest) (
+	*api.AddServerResponse, error) {
+	return s.addServer(ctx, req, false)
+}
+
+func (s *adminServer) addServer(ctx context.Context, req *api.AddServerRequest, voter bool) (
+	*api.AddServerResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	if req.Id == "" || req.RpcAddr == "" {
+		return nil, status.Error(codes.InvalidArgument, "server id and rpc_addr are required")
+	}
+	err := s.onLeaders(ctx, req.Partitions,
+		func(p uint32) error {
+			return s.RaftAdmin.AddServer(p, req.Id, req.RpcAddr, voter)
+		},
+		func(ctx context.Context, leader api.AdminClient, p uint32) error {
+			forward := leader.AddNonvoter
+			if voter {
+				forward = leader.AddVoter
+			}
+			_, err := forward(ctx, &api.AddServerRequest{
+				Partitions: []uint32{p},
+				Id:         req.Id,
+				RpcAddr:    req.RpcAddr,
+			})
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddServerResponse{}, nil
+}
+
+/*
+ListRaftConfiguration returns the servers in the partition's group, as this
+server knows them, along with each server's own status, which is fetched from
+the other servers in parallel. Servers whose status can't be fetched are
+listed with the error instead.
+*/
+func (s *adminServer) ListRaftConfiguration(ctx context.Context,
+	req *api.ListRaftConfigurationRequest) (*api.ListRaftConfigurationResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	servers, err := s.RaftAdmin.RaftConfiguration(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if server.Status != nil {
+			continue
+		}
+		if s.Forwarder == nil {
+			server.Error = "no connection to other servers"
+			continue
+		}
+		wg.Add(1)
+		go func(server *api.RaftServer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, raftStatusTimeout)
+			defer cancel()
+			conn, err := s.Forwarder.conn(server.RpcAddr)
+			if err == nil {
+				server.Status, err = api.NewAdminClient(conn).GetRaftStatus(ctx,
+					&api.GetRaftStatusRequest{Partition: req.Partition})
+			}
+			if err != nil {
+				server.Error = err.Error()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return &api.ListRaftConfigurationResponse{Servers: servers}, nil
+}
+
+func (s *adminServer) GetRaftStatus(ctx context.Context, req *api.GetRaftStatusRequest) (
+	*api.RaftStatus, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return s.RaftAdmin.RaftStatus(req.Partition)
+}
+
+// TriggerSnapshot has the groups take a snapshot on this server.
+func (s *adminServer) TriggerSnapshot(ctx context.Context, req *api.TriggerSnapshotRequest) (
+	*api.TriggerSnapshotResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	for _, p := range s.partitions(req.Partitions) {
+		if err := s.RaftAdmin.Snapshot(p); err != nil {
+			return nil, err
+		}
+	}
+	return &api.TriggerSnapshotResponse{}, nil
+}
+
+func (s *adminServer) authorize(ctx context.Context) error {
+	return s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction)
+}
+
+// partitions returns the partitions a request lists, or every partition when
+// it lists none.
+func (s *adminServer) partitions(partitions []uint32) []uint32 {
+	if len(partitions) > 0 {
+		return partitions
+	}
+	for p := uint32(0); p < s.CommitLog.PartitionCount(); p++ {
+		partitions = append(partitions, p)
+	}
+	return partitions
+}
+
+/*
+onLeaders makes a change to each of the partitions' groups on the group's
+leader: change makes it to the groups this server leads, and forward asks the
+leaders of the other groups to make it to theirs, one group at a time.
+*/
+func (s *adminServer) onLeaders(ctx context.Context, partitions []uint32,
+	change func(p uint32) error,
+	forward func(ctx context.Context, leader api.AdminClient, p uint32) error,
+) error {
+	for _, p := range s.partitions(partitions) {
+		conn, ctx, err := s.leaderConn(ctx, p)
+		if err != nil {
+			return err
+		}
+		if conn != nil {
+			err = forward(ctx, api.NewAdminClient(conn), p)
+		} else {
+			err = change(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/test_util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+)
+
+// raftAdmin is a RaftAdmin that records the changes made to each partition.
+type raftAdmin struct {
+	id      string
+	mu      sync.Mutex
+	changes map[uint32][]string
+	servers []*api.RaftServer
+}
+
+func newRaftAdmin(id string) *raftAdmin {
+	return &raftAdmin{id: id, changes: make(map[uint32][]string)}
+}
+
+func (a *raftAdmin) change(partition uint32, change string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.changes[partition] = append(a.changes[partition], change)
+	return nil
+}
+
+func (a *raftAdmin) TransferLeadership(partition uint32, id string) error {
+	return a.change(partition, "transfer "+id)
+}
+
+func (a *raftAdmin) RemoveServer(partition uint32, id string) error {
+	return a.change(partition, "remove "+id)
+}
+
+func (a *raftAdmin) AddServer(partition uint32, id, addr string, voter bool) error {
+	if voter {
+		return a.change(partition, "add voter "+id)
+	}
+	return a.change(partition, "add nonvoter "+id)
+}
+
+func (a *raftAdmin) RaftConfiguration(partition uint32) ([]*api.RaftServer, error) {
+	return a.servers, nil
+}
+
+func (a *raftAdmin) RaftStatus(partition uint32) (*api.RaftStatus, error) {
+	return &api.RaftStatus{State: a.id}, nil
+}
+
+func (a *raftAdmin) Snapshot(partition uint32) error {
+	return a.change(partition, "snapshot")
+}
+
+func TestAdmin(t *testing.T) {
+	peerTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile: test_util.RootClientCertFile,
+		KeyFile:  test_util.RootClientKeyFile,
+		CAFile:   test_util.CAFile,
+	})
+	require.NoError(t, err)
+	leaderAdmin := newRaftAdmin("leader")
+	leaderAddr, _ := setupForwardServer(t, nil, leaderAdmin)
+	followerAdmin := newRaftAdmin("follower")
+	followerLocator := leaders{}
+	followerAddr, _ := setupForwardServer(t,
+		NewForwarder(followerLocator, peerTLSConfig), followerAdmin)
+	// partition 0 is led by the leader, partition 1 by the follower
+	followerLocator[0] = leaderAddr
+
+	conn, client := newAdminClient(t, followerAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer conn.Close()
+	ctx := context.Background()
+
+	// changes are made by each partition's leader, to every partition by default
+	_, err = client.TransferLeadership(ctx, &api.TransferLeadershipRequest{Id: "a"})
+	require.NoError(t, err)
+	_, err = client.AddNonvoter(ctx, &api.AddServerRequest{
+		Partitions: []uint32{0},
+		Id:         "b",
+		RpcAddr:    "localhost:1",
+	})
+	require.NoError(t, err)
+	_, err = client.AddVoter(ctx, &api.AddServerRequest{
+		Partitions: []uint32{1},
+		Id:         "b",
+		RpcAddr:    "localhost:1",
+	})
+	require.NoError(t, err)
+	_, err = client.RemoveServer(ctx, &api.RemoveServerRequest{Id: "c"})
+	require.NoError(t, err)
+	require.Equal(t, map[uint32][]string{
+		0: {"transfer a", "add nonvoter b", "remove c"},
+	}, leaderAdmin.changes)
+	require.Equal(t, map[uint32][]string{
+		1: {"transfer a", "add voter b", "remove c"},
+	}, followerAdmin.changes)
+
+	// while snapshots are taken locally
+	_, err = client.TriggerSnapshot(ctx, &api.TriggerSnapshotRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "snapshot", followerAdmin.changes[0][0])
+	require.Equal(t, "remove c", leaderAdmin.changes[0][2])
+
+	_, err = client.RemoveServer(ctx, &api.RemoveServerRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.AddVoter(ctx, &api.AddServerRequest{Id: "b"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the configuration lists each server's own status
+	followerAdmin.servers = []*api.RaftServer{
+		{Id: "leader", RpcAddr: leaderAddr, IsLeader: true},
+		{Id: "follower", RpcAddr: followerAddr, Status: &api.RaftStatus{State: "follower"}},
+		{Id: "down", RpcAddr: "127.0.0.1:0"},
+	}
+	config, err := client.ListRaftConfiguration(ctx, &api.ListRaftConfigurationRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(config.Servers))
+	require.Equal(t, "leader", config.Servers[0].Status.State)
+	require.Equal(t, "", config.Servers[0].Error)
+	require.Equal(t, "follower", config.Servers[1].Status.State)
+	require.Nil(t, config.Servers[2].Status)
+	require.NotEqual(t, "", config.Servers[2].Error)
+
+	// only admins can administer the groups
+	nobodyConn, nobody := newAdminClient(t, followerAddr,
+		test_util.NobodyClientCertFile, test_util.NobodyClientKeyFile)
+	defer nobodyConn.Close()
+	_, err = nobody.TransferLeadership(ctx, &api.TransferLeadershipRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.GetRaftStatus(ctx, &api.GetRaftStatusRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func newAdminClient(t *testing.T, serverAddress, crtPath, keyPath string) (
+	*grpc.ClientConn, api.AdminClient) {
+	t.Helper()
+	clientTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile: crtPath,
+		KeyFile:  keyPath,
+		CAFile:   test_util.CAFile,
+	})
+	require.NoError(t, err)
+	cc, err := grpc.Dial(serverAddress,
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))
+	require.NoError(t, err)
+	return cc, api.NewAdminClient(cc)
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	rangeStrategy      = "range"
+	roundRobinStrategy = "roundrobin"
+
+	defaultSessionTimeout = 10 * time.Second
+)
+
+// coordinatorPartition is the partition whose leader coordinates every group.
+// Servers forward the group RPCs they get to it.
+const coordinatorPartition = 0
+
+/*
+coordinator keeps track of the members of consumer groups and assigns each
+member the partitions it consumes. Groups live in the memory of the leader of
+coordinatorPartition, which every server forwards the group RPCs to, so members
+can join and heartbeat through any server and still share one view of their
+group. Groups aren't replicated: when the leadership moves, the new leader
+doesn't know the members, whose heartbeats fail until they join again.
+
+Members that haven't heartbeated within their session timeout are removed the
+next time anyone uses their group. Every change of a group's members bumps its
+generation and assigns its partitions again.
+*/
+type coordinator struct {
+	mu     sync.Mutex
+	groups map[string]*group
+	// partitions returns the number of partitions of every topic.
+	partitions func() uint32
+}
+
+type group struct {
+	strategy   string
+	generation uint64
+	members    map[string]*member
+}
+
+type member struct {
+	id          string
+	topics      []string
+	timeout     time.Duration
+	expires     time.Time
+	assignments []*api.Assignment
+}
+
+func newCoordinator(partitions func() uint32) *coordinator {
+	return &coordinator{
+		groups:     make(map[string]*group),
+		partitions: partitions,
+	}
+}
+
+// Join adds the member to the group, or updates the topics of a member that's
+// already in it, and assigns the group's partitions again.
+func (c *coordinator) Join(req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	strategy := req.Strategy
+	if strategy == "" {
+		strategy = rangeStrategy
+	}
+	if strategy != rangeStrategy && strategy != roundRobinStrategy {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unknown assignment strategy: %q", strategy)
+	}
+	timeout := time.Duration(req.SessionTimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultSessionTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.group(req.Group)
+	if !ok {
+		g = &group{members: make(map[string]*member)}
+		c.groups[req.Group] = g
+	}
+	if len(g.members) == 0 {
+		g.strategy = strategy
+	} else if strategy != g.strategy {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"group %q assigns partitions with the %q strategy", req.Group, g.strategy)
+	}
+	m, ok := g.members[req.MemberId]
+	if !ok {
+		if req.MemberId != "" {
+			return nil, api.ErrUnknownMember{Group: req.Group, MemberID: req.MemberId}
+		}
+		m = &member{id: newMemberID()}
+		g.members[m.id] = m
+	}
+	m.topics = nil
+	seen := make(map[string]bool)
+	for _, topic := range req.Topics {
+		if !seen[topic] {
+			seen[topic] = true
+			m.topics = append(m.topics, topic)
+		}
+	}
+	m.timeout = timeout
+	m.expires = time.Now().Add(timeout)
+	c.rebalance(g)
+	return &api.JoinGroupResponse{
+		MemberId:    m.id,
+		Generation:  g.generation,
+		Assignments: m.assignments,
+	}, nil
+}
+
+// Heartbeat keeps the member in the group and returns its current assignment.
+func (c *coordinator) Heartbeat(req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, g, err := c.member(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	m.expires = time.Now().Add(m.timeout)
+	return &api.HeartbeatResponse{
+		Generation:  g.generation,
+		Assignments: m.assignments,
+	}, nil
+}
+
+// Leave removes the member from the group, handing its partitions to the other
+// members.
+func (c *coordinator) Leave(req *api.LeaveGroupRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, g, err := c.member(req.Group, req.MemberId)
+	if err != nil {
+		return err
+	}
+	delete(g.members, req.MemberId)
+	if len(g.members) == 0 {
+		delete(c.groups, req.Group)
+		return nil
+	}
+	c.rebalance(g)
+	return nil
+}
+
+// member returns the member of the group with the given ID. The caller must
+// hold the lock.
+func (c *coordinator) member(name, id string) (*member, *group, error) {
+	g, ok := c.group(name)
+	if !ok {
+		return nil, nil, api.ErrUnknownMember{Group: name, MemberID: id}
+	}
+	m, ok := g.members[id]
+	if !ok {
+		return nil, nil, api.ErrUnknownMember{Group: name, MemberID: id}
+	}
+	return m, g, nil
+}
+
+// group returns the named group after removing the members whose sessions
+// have expired. Groups without members are forgotten. The caller must hold the
+// lock.
+func (c *coordinator) group(name string) (*group, bool) {
+	g, ok := c.groups[name]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	expired := false
+	for id, m := range g.members {
+		if now.After(m.expires) {
+			delete(g.members, id)
+			expired = true
+		}
+	}
+	if expired {
+		c.rebalance(g)
+	}
+	if len(g.members) == 0 {
+		delete(c.groups, name)
+		return nil, false
+	}
+	return g, true
+}
+
+// rebalance starts a new generation of the group and assigns its partitions
+// to its members.
+func (c *coordinator) rebalance(g *group) {
+	g.generation++
+	assign := assignRange
+	if g.strategy == roundRobinStrategy {
+		assign = assignRoundRobin
+	}
+	for _, m := range g.members {
+		m.assignments = nil
+	}
+	assign(sortedMembers(g.members), c.partitions())
+}
+
+func sortedMembers(members map[string]*member) []*member {
+	sorted := make([]*member, 0, len(members))
+	for _, m := range members {
+		sorted = append(sorted, m)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].id < sorted[j].id
+	})
+	return sorted
+}
+
+// subscribedTopics returns the topics that any of the members consume, in
+// order, and the members that consume each.
+func subscribedTopics(members []*member) ([]string, map[string][]*member) {
+	subscribers := make(map[string][]*member)
+	var topics []string
+	for _, m := range members {
+		for _, topic := range m.topics {
+			if _, ok := subscribers[topic]; !ok {
+				topics = append(topics, topic)
+			}
+			subscribers[topic] = append(subscribers[topic], m)
+		}
+	}
+	sort.Strings(topics)
+	return topics, subscribers
+}
+
+/*
+assignRange splits each topic's partitions into contiguous ranges, one for each
+of the members consuming the topic in order of their IDs. When the partitions
+don't split evenly, the first members get one partition more.
+*/
+func assignRange(members []*member, partitions uint32) {
+	topics, subscribers := subscribedTopics(members)
+	for _, topic := range topics {
+		subs := subscribers[topic]
+		n := uint32(len(subs))
+		per, extra := partitions/n, partitions%n
+		var next uint32
+		for i, m := range subs {
+			count := per
+			if uint32(i) < extra {
+				count++
+			}
+			if count == 0 {
+				continue
+			}
+			a := &api.Assignment{Topic: topic}
+			for p := next; p < next+count; p++ {
+				a.Partitions = append(a.Partitions, p)
+			}
+			next += count
+			m.assignments = append(m.assignments, a)
+		}
+	}
+}
+
+/*
+assignRoundRobin deals every topic's partitions out to the members one at a
+time, in order of topic and partition, skipping members that don't consume the
+topic. This spreads the partitions more evenly than assignRange when members
+consume several topics.
+*/
+func assignRoundRobin(members []*member, partitions uint32) {
+	topics, subscribers := subscribedTopics(members)
+	assignments := make(map[*member]map[string]*api.Assignment)
+	next := 0
+	for _, topic := range topics {
+		subscribed := make(map[*member]bool)
+		for _, m := range subscribers[topic] {
+			subscribed[m] = true
+		}
+		for p := uint32(0); p < partitions; p++ {
+			for !subscribed[members[next%len(members)]] {
+				next++
+			}
+			m := members[next%len(members)]
+			next++
+			if assignments[m] == nil {
+				assignments[m] = make(map[string]*api.Assignment)
+			}
+			a, ok := assignments[m][topic]
+			if !ok {
+				a = &api.Assignment{Topic: topic}
+				assignments[m][topic] = a
+				m.assignments = append(m.assignments, a)
+			}
+			a.Partitions = append(a.Partitions, p)
+		}
+	}
+}
+
+func newMemberID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
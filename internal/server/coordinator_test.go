@@ -0,0 +1,118 @@
+package server
+
+import (
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestAssignRange(t *testing.T) {
+	a, b, c := &member{id: "a"}, &member{id: "b"}, &member{id: "c"}
+	a.topics = []string{"orders", "events"}
+	b.topics = []string{"orders", "events"}
+	c.topics = []string{"events"}
+	assignRange([]*member{a, b, c}, 5)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "events", Partitions: []uint32{0, 1}},
+		{Topic: "orders", Partitions: []uint32{0, 1, 2}},
+	}, a.assignments)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "events", Partitions: []uint32{2, 3}},
+		{Topic: "orders", Partitions: []uint32{3, 4}},
+	}, b.assignments)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "events", Partitions: []uint32{4}},
+	}, c.assignments)
+
+	// members beyond the number of partitions get nothing
+	a, b = &member{id: "a"}, &member{id: "b"}
+	a.topics, b.topics = []string{"orders"}, []string{"orders"}
+	assignRange([]*member{a, b}, 1)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "orders", Partitions: []uint32{0}},
+	}, a.assignments)
+	require.Empty(t, b.assignments)
+}
+
+func TestAssignRoundRobin(t *testing.T) {
+	a, b, c := &member{id: "a"}, &member{id: "b"}, &member{id: "c"}
+	a.topics = []string{"orders", "events"}
+	b.topics = []string{"orders", "events"}
+	c.topics = []string{"events"}
+	assignRoundRobin([]*member{a, b, c}, 3)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "events", Partitions: []uint32{0}},
+		{Topic: "orders", Partitions: []uint32{0, 2}},
+	}, a.assignments)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "events", Partitions: []uint32{1}},
+		{Topic: "orders", Partitions: []uint32{1}},
+	}, b.assignments)
+	require.Equal(t, []*api.Assignment{
+		{Topic: "events", Partitions: []uint32{2}},
+	}, c.assignments)
+}
+
+func TestCoordinator(t *testing.T) {
+	c := newCoordinator(func() uint32 { return 4 })
+	join := func(id string, timeout time.Duration) *api.JoinGroupResponse {
+		res, err := c.Join(&api.JoinGroupRequest{
+			Group:            "billing",
+			MemberId:         id,
+			Topics:           []string{"orders"},
+			SessionTimeoutMs: uint32(timeout / time.Millisecond),
+		})
+		require.NoError(t, err)
+		return res
+	}
+	first := join("", time.Minute)
+	require.Equal(t, uint64(1), first.Generation)
+	require.Equal(t, []uint32{0, 1, 2, 3}, first.Assignments[0].Partitions)
+
+	// a new member takes half the partitions, and the first member learns
+	// about it from its next heartbeat
+	second := join("", 50*time.Millisecond)
+	require.Equal(t, uint64(2), second.Generation)
+	require.Len(t, second.Assignments[0].Partitions, 2)
+	heartbeat, err := c.Heartbeat(&api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), heartbeat.Generation)
+	require.Len(t, heartbeat.Assignments[0].Partitions, 2)
+
+	// the group's strategy can't change while it has members
+	_, err = c.Join(&api.JoinGroupRequest{
+		Group:    "billing",
+		Strategy: roundRobinStrategy,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// a member that misses its session timeout is removed
+	time.Sleep(100 * time.Millisecond)
+	heartbeat, err = c.Heartbeat(&api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), heartbeat.Generation)
+	require.Equal(t, []uint32{0, 1, 2, 3}, heartbeat.Assignments[0].Partitions)
+	_, err = c.Heartbeat(&api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: second.MemberId}, err)
+
+	// the group is forgotten once its last member leaves
+	require.NoError(t, c.Leave(&api.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	}))
+	require.Empty(t, c.groups)
+	err = c.Leave(&api.LeaveGroupRequest{Group: "billing", MemberId: first.MemberId})
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: first.MemberId}, err)
+}
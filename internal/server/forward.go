@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"sync"
+	"time"
+)
+
+// forwardedKey marks requests a server forwarded to a leader, which the leader
+// never forwards again, so servers with different ideas of who leads can't
+// pass a request back and forth. It holds the subject of the caller the request
+// was forwarded for.
+const forwardedKey = "loghouse-forwarded"
+
+// redirectTimeout bounds how long a write that lost its leader waits to hear
+// from the partition's new one.
+const redirectTimeout = 10 * time.Second
+
+// LeaderLocator finds the leaders of partitions. LeaderAddr returns the empty
+// string when this server leads the partition.
+type LeaderLocator interface {
+	LeaderAddr(partition uint32) (string, error)
+}
+
+/*
+Forwarder lets a server accept writes to partitions it doesn't lead by passing
+them on to the partition's leader, so clients that can't route writes to the
+leader themselves can write through any server. LEADER_VERIFIED reads and
+changes to the Raft groups made through the Admin service are forwarded the
+same way.
+
+The server authorizes the caller before forwarding its requests, and the leader
+authorizes them again as the same caller, whose subject they carry. Forwarded
+requests are made over TLS with the server's peer certificate, whose subject
+needs to be allowed the forward action for the leader to trust the subject the
+requests claim to be for.
+*/
+type Forwarder struct {
+	leaders  LeaderLocator
+	dialOpts []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewForwarder creates a Forwarder that connects to leaders with tlsConfig, or
+// without TLS when it's nil.
+func NewForwarder(leaders LeaderLocator, tlsConfig *tls.Config) *Forwarder {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	return &Forwarder{
+		leaders:  leaders,
+		dialOpts: []grpc.DialOption{grpc.WithTransportCredentials(creds)},
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+}
+
+// leaderConn returns a connection to the partition's leader, or nil when this
+// server is its leader.
+func (f *Forwarder) leaderConn(partition uint32) (*grpc.ClientConn, error) {
+	addr, err := f.leaders.LeaderAddr(partition)
+	if err != nil || addr == "" {
+		return nil, err
+	}
+	return f.conn(addr)
+}
+
+// conn returns a connection to the server at addr. Connections are kept open
+// for later requests.
+func (f *Forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn, ok := f.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.Dial(addr, f.dialOpts...); err != nil {
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	return conn, nil
+}
+
+// Close closes the connections to the leaders.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	for addr, conn := range f.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(f.conns, addr)
+	}
+	return err
+}
+
+// forwarded reports whether another server forwarded the request.
+func forwarded(ctx context.Context) bool {
+	_, ok := forwardedFor(ctx)
+	return ok
+}
+
+// forwardedFor returns the subject of the caller another server forwarded the
+// request for, if it was forwarded.
+func forwardedFor(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	subjects := md.Get(forwardedKey)
+	if len(subjects) == 0 {
+		return "", false
+	}
+	return subjects[0], true
+}
+
+/*
+leaderConn returns a connection to the partition's leader when the server
+should forward requests for the partition's leader there, along with the
+context to forward them with. It returns a nil connection when the requests
+should be served here: when the server leads the partition, has no Forwarder,
+or was forwarded the request itself. Partitions that don't exist are left for
+the log to report.
+*/
+func (c *Config) leaderConn(ctx context.Context, partition uint32) (
+	*grpc.ClientConn, context.Context, error) {
+	if c.Forwarder == nil || forwarded(ctx) || partition >= c.CommitLog.PartitionCount() {
+		return nil, ctx, nil
+	}
+	conn, err := c.Forwarder.leaderConn(partition)
+	if err != nil || conn == nil {
+		return nil, ctx, err
+	}
+	return conn, metadata.AppendToOutgoingContext(ctx, forwardedKey, subject(ctx)), nil
+}
+
+// leader returns a client of the partition's leader when the request should be
+// forwarded there, as leaderConn does.
+func (s *grpcServer) leader(ctx context.Context, partition uint32) (
+	api.LogClient, context.Context, error) {
+	conn, ctx, err := s.leaderConn(ctx, partition)
+	if err != nil || conn == nil {
+		return nil, ctx, err
+	}
+	return api.NewLogClient(conn), ctx, nil
+}
+
+/*
+redirect returns a client of the partition's new leader when a write failed
+with api.ErrNotLeader because the server stopped leading the partition while
+the write was waiting, as it does when the server drains its leadership before
+shutting down. Such writes weren't applied, so they can be forwarded. The server
+may not have heard from the new leader yet, so redirect waits for it until the
+request is done or redirectTimeout passes.
+*/
+func (s *grpcServer) redirect(ctx context.Context, partition uint32, err error) (
+	api.LogClient, context.Context) {
+	if _, ok := err.(api.ErrNotLeader); !ok {
+		return nil, ctx
+	}
+	deadline := time.After(redirectTimeout)
+	for {
+		leader, fctx, err := s.leader(ctx, partition)
+		if _, ok := err.(api.ErrNoLeader); !ok {
+			if err != nil {
+				return nil, ctx
+			}
+			return leader, fctx
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx
+		case <-deadline:
+			return nil, ctx
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	api "github.com/anshulsood11/loghouse/api/v1"
+	"github.com/anshulsood11/loghouse/internal/auth"
+	"github.com/anshulsood11/loghouse/internal/log"
+	"github.com/anshulsood11/loghouse/internal/test_util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// leaders is a LeaderLocator with fixed leader addresses.
+type leaders map[uint32]string
+
+func (l leaders) LeaderAddr(partition uint32) (string, error) {
+	return l[partition], nil
+}
+
+func TestForwardProduce(t *testing.T) {
+	peerTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile: test_util.RootClientCertFile,
+		KeyFile:  test_util.RootClientKeyFile,
+		CAFile:   test_util.CAFile,
+	})
+	require.NoError(t, err)
+	leaderLocator := leaders{}
+	leaderAddr, leaderLog := setupForwardServer(t,
+		NewForwarder(leaderLocator, peerTLSConfig), nil)
+	followerLocator := leaders{}
+	followerAddr, followerLog := setupForwardServer(t,
+		NewForwarder(followerLocator, peerTLSConfig), nil)
+	// partition 0 is led by the leader, partition 1 by the follower
+	followerLocator[0] = leaderAddr
+
+	conn, client, _ := newClient(t, followerAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer conn.Close()
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("forwarded")},
+	})
+	require.NoError(t, err)
+	record, err := leaderLog.Read("", 0, produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("forwarded"), record.Value)
+	_, err = followerLog.Read("", 0, produce.Offset)
+	require.Error(t, err)
+
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("batch")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, batch.FirstOffset)
+
+	// leader-verified reads are served by the leader, even as a stream
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_LEADER_VERIFIED,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("forwarded"), consume.Record.Value)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:      batch.FirstOffset,
+		Consistency: api.Consistency_LEADER_VERIFIED,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("batch"), res.Record.Value)
+	// while local reads only see the follower's log
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.Error(t, err)
+
+	// writes to partitions the follower leads stay on the follower
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("local")},
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	record, err = followerLog.Read("", 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("local"), record.Value)
+
+	// offsets are committed on the partition's leader, wherever the client
+	// sends them
+	leaderConn, leaderClient, _ := newClient(t, leaderAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer leaderConn.Close()
+	leaderLocator[1] = followerAddr
+	for p, c := range []api.LogClient{client, leaderClient} {
+		_, err = c.CommitOffset(ctx, &api.CommitOffsetRequest{
+			Group:     "billing",
+			Partition: uint32(p),
+			Offset:    1,
+		})
+		require.NoError(t, err)
+	}
+	offset, committed, err := leaderLog.FetchOffset("billing", "", 0)
+	require.NoError(t, err)
+	require.True(t, committed)
+	require.Equal(t, uint64(1), offset)
+	offset, committed, err = followerLog.FetchOffset("billing", "", 1)
+	require.NoError(t, err)
+	require.True(t, committed)
+	require.Equal(t, uint64(1), offset)
+	_, committed, err = leaderLog.FetchOffset("billing", "", 1)
+	require.NoError(t, err)
+	require.False(t, committed)
+
+	// the caller is authorized before its writes are forwarded
+	nobodyConn, nobody, _ := newClient(t, followerAddr,
+		test_util.NobodyClientCertFile, test_util.NobodyClientKeyFile)
+	defer nobodyConn.Close()
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("denied")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestForwardOnce(t *testing.T) {
+	peerTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile: test_util.RootClientCertFile,
+		KeyFile:  test_util.RootClientKeyFile,
+		CAFile:   test_util.CAFile,
+	})
+	require.NoError(t, err)
+	// each server thinks the other leads partition 0
+	aLocator, bLocator := leaders{}, leaders{}
+	aAddr, aLog := setupForwardServer(t, NewForwarder(aLocator, peerTLSConfig), nil)
+	bAddr, bLog := setupForwardServer(t, NewForwarder(bLocator, peerTLSConfig), nil)
+	aLocator[0], bLocator[0] = bAddr, aAddr
+
+	conn, client, _ := newClient(t, aAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer conn.Close()
+	produce, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("once")},
+	})
+	require.NoError(t, err)
+	_, err = aLog.Read("", 0, produce.Offset)
+	require.Error(t, err)
+	record, err := bLog.Read("", 0, produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("once"), record.Value)
+}
+
+func TestForwardAuthorizesCaller(t *testing.T) {
+	peerTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile: test_util.RootClientCertFile,
+		KeyFile:  test_util.RootClientKeyFile,
+		CAFile:   test_util.CAFile,
+	})
+	require.NoError(t, err)
+	leaderAddr, leaderLog := setupForwardServer(t, nil, nil)
+	// the follower lets anyone write, but the leader authorizes the caller a
+	// write was forwarded for, not the follower that forwarded it
+	followerLocator := leaders{0: leaderAddr}
+	followerAddr, _ := setupAuthorizedServer(t,
+		NewForwarder(followerLocator, peerTLSConfig), nil, auth.AllowAll{})
+	ctx := context.Background()
+	nobodyConn, nobody, _ := newClient(t, followerAddr,
+		test_util.NobodyClientCertFile, test_util.NobodyClientKeyFile)
+	defer nobodyConn.Close()
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("denied")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = leaderLog.Read("", 0, 0)
+	require.Error(t, err)
+	rootConn, root, _ := newClient(t, followerAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer rootConn.Close()
+	_, err = root.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("allowed")},
+	})
+	require.NoError(t, err)
+
+	// and only servers allowed to forward can say whom a request is for
+	leaderNobodyConn, leaderNobody, _ := newClient(t, leaderAddr,
+		test_util.NobodyClientCertFile, test_util.NobodyClientKeyFile)
+	defer leaderNobodyConn.Close()
+	_, err = leaderNobody.Produce(metadata.AppendToOutgoingContext(ctx, forwardedKey, "root"),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("forged")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	record, err := leaderLog.Read("", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("allowed"), record.Value)
+	_, err = leaderLog.Read("", 0, 1)
+	require.Error(t, err)
+}
+
+func TestForwardGroups(t *testing.T) {
+	peerTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile: test_util.RootClientCertFile,
+		KeyFile:  test_util.RootClientKeyFile,
+		CAFile:   test_util.CAFile,
+	})
+	require.NoError(t, err)
+	leaderAddr, _ := setupForwardServer(t, nil, nil)
+	followerAddr, _ := setupForwardServer(t,
+		NewForwarder(leaders{0: leaderAddr}, peerTLSConfig), nil)
+	leaderConn, leader, _ := newClient(t, leaderAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer leaderConn.Close()
+	followerConn, follower, _ := newClient(t, followerAddr,
+		test_util.RootClientCertFile, test_util.RootClientKeyFile)
+	defer followerConn.Close()
+
+	// members that join through different servers are in the same group, and
+	// split its partitions between them
+	ctx := context.Background()
+	join := &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}}
+	first, err := follower.JoinGroup(ctx, join)
+	require.NoError(t, err)
+	second, err := leader.JoinGroup(ctx, join)
+	require.NoError(t, err)
+	require.Len(t, second.Assignments[0].Partitions, 1)
+	heartbeat, err := follower.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, second.Generation, heartbeat.Generation)
+	require.Len(t, heartbeat.Assignments[0].Partitions, 1)
+	require.NotEqual(t, second.Assignments[0].Partitions,
+		heartbeat.Assignments[0].Partitions)
+
+	_, err = follower.LeaveGroup(ctx, &api.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	heartbeat, err = leader.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1}, heartbeat.Assignments[0].Partitions)
+}
+
+// setupForwardServer runs a server with two partitions, the forwarder and the
+// Raft admin, and returns its address and log.
+func setupForwardServer(t *testing.T, forwarder *Forwarder, admin RaftAdmin) (
+	string, log.Partitions) {
+	t.Helper()
+	return setupAuthorizedServer(t, forwarder, admin,
+		auth.NewAuthorizer(test_util.ACLModelFile, test_util.ACLPolicyFile))
+}
+
+// setupAuthorizedServer runs a server like setupForwardServer's that
+// authorizes requests with the authorizer.
+func setupAuthorizedServer(t *testing.T, forwarder *Forwarder, admin RaftAdmin,
+	authorizer Authorizer) (string, log.Partitions) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverTLSConfig, err := test_util.SetupTLSConfig(test_util.TLSConfig{
+		CertFile:      test_util.ServerCertFile,
+		KeyFile:       test_util.ServerKeyFile,
+		CAFile:        test_util.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "forward-test")
+	require.NoError(t, err)
+	c := log.Config{}
+	c.Partitions = 2
+	clog, err := log.NewPartitions(dir, c)
+	require.NoError(t, err)
+	server, err := NewGRPCServer(&Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+		Forwarder:  forwarder,
+		RaftAdmin:  admin,
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go func() {
+		server.Serve(l)
+	}()
+	t.Cleanup(func() {
+		server.Stop()
+		if forwarder != nil {
+			forwarder.Close()
+		}
+		l.Close()
+		clog.Remove()
+	})
+	return l.Addr().String(), clog
+}
@@ -17,16 +17,31 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"io"
 	"time"
 )
 
 /*
 CommitLog interface for Dependency Inversion so that the service is not tied
-to a specific log implementation.
+to a specific log implementation. Records are kept in named topics, and the
+empty topic name refers to the default topic. Every topic is split into
+PartitionCount partitions, each with its own offsets.
 */
 type CommitLog interface {
-	Append(*api.Record) (uint64, error)
-	Read(uint64) (*api.Record, error)
+	Append(topic string, partition uint32, record *api.Record) (uint64, error)
+	AppendBatch(topic string, partition uint32, records []*api.Record) (uint64, error)
+	Read(topic string, partition uint32, off uint64) (*api.Record, error)
+	ReadRange(topic string, partition uint32, from, maxRecords, maxBytes uint64) (
+		[]*api.Record, error)
+	WaitForOffset(ctx context.Context, topic string, partition uint32, off uint64) error
+	VerifyLeader(partition uint32) error
+	OffsetForTime(topic string, partition uint32, timestamp int64) (uint64, error)
+	CreateTopic(name string) error
+	DeleteTopic(name string) error
+	ListTopics() ([]string, error)
+	PartitionCount() uint32
+	CommitOffset(group, topic string, partition uint32, offset uint64) error
+	FetchOffset(group, topic string, partition uint32) (uint64, bool, error)
 }
 
 type Authorizer interface {
@@ -41,12 +56,30 @@ type Config struct {
 	CommitLog      CommitLog
 	Authorizer     Authorizer
 	ServersFetcher ServersFetcher
+	// Forwarder forwards writes, and reads that must be served by the leader,
+	// to the leaders of partitions the server doesn't lead. Without one, they
+	// fail.
+	Forwarder *Forwarder
+	// RaftAdmin serves the Admin service, which is only registered when the
+	// log is replicated.
+	RaftAdmin RaftAdmin
 }
 
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
+	forwardAction  = "forward"
+
+	// maxProduceStreamBatch caps how many waiting ProduceStream requests are
+	// appended to the log together.
+	maxProduceStreamBatch = 1024
+	// defaultConsumeBatchRecords and defaultConsumeBatchBytes are the limits of
+	// a ConsumeBatch request that doesn't set its own. The byte limit keeps the
+	// response well under gRPC's default 4MB message size limit.
+	defaultConsumeBatchRecords = 1000
+	defaultConsumeBatchBytes   = 1 << 20
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -54,6 +87,7 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	coordinator *coordinator
 }
 
 func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
@@ -74,20 +108,24 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
 			grpc_ctxtags.StreamServerInterceptor(),
 			grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
+			grpc_auth.StreamServerInterceptor(config.authenticate),
 		)),
 		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 			grpc_ctxtags.UnaryServerInterceptor(),
 			grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-			grpc_auth.UnaryServerInterceptor(authenticate),
+			grpc_auth.UnaryServerInterceptor(config.authenticate),
 		)),
 		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
 	)
 	gsrvr := grpc.NewServer(grpcOpts...)
-	srv := &grpcServer{
-		Config: config,
-	}
+	srv := &grpcServer{Config: config}
+	srv.coordinator = newCoordinator(func() uint32 {
+		return srv.CommitLog.PartitionCount()
+	})
 	api.RegisterLogServer(gsrvr, srv)
+	if config.RaftAdmin != nil {
+		api.RegisterAdminServer(gsrvr, &adminServer{Config: config})
+	}
 	return gsrvr, nil
 }
 
@@ -96,25 +134,266 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	leader, ctx, err := s.leader(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.Produce(ctx, req)
+	}
+	offset, err := s.CommitLog.Append(req.Topic, req.Partition, req.Record)
+	if leader, ctx := s.redirect(ctx, req.Partition, err); leader != nil {
+		return leader.Produce(ctx, req)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (
+	*api.ProduceBatchResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+		return nil, err
+	}
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no records")
+	}
+	for _, record := range req.Records {
+		if record == nil {
+			return nil, status.Error(codes.InvalidArgument, "batch has a missing record")
+		}
+	}
+	leader, ctx, err := s.leader(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.ProduceBatch(ctx, req)
+	}
+	offset, err := s.CommitLog.AppendBatch(req.Topic, req.Partition, req.Records)
+	if leader, ctx := s.redirect(ctx, req.Partition, err); leader != nil {
+		return leader.ProduceBatch(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceBatchResponse{FirstOffset: offset}, nil
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	leader, ctx, err := s.consistent(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.Consume(ctx, req)
+	}
+	record, err := s.CommitLog.Read(req.Topic, req.Partition, req.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+/*
+consistent makes sure the server's copy of the partition is as up to date as
+the request's consistency mode asks for before it's read. LEADER_VERIFIED reads
+have to be served by the partition's leader, so on other servers consistent
+returns a client of the leader to forward the read to, along with the context
+to forward it with.
+*/
+func (s *grpcServer) consistent(ctx context.Context, req *api.ConsumeRequest) (
+	api.LogClient, context.Context, error) {
+	switch req.Consistency {
+	case api.Consistency_LOCAL:
+		return nil, ctx, nil
+	case api.Consistency_LEADER_VERIFIED:
+		leader, ctx, err := s.leader(ctx, req.Partition)
+		if err != nil || leader != nil {
+			return leader, ctx, err
+		}
+		return nil, ctx, s.CommitLog.VerifyLeader(req.Partition)
+	case api.Consistency_AT_LEAST:
+		err := s.CommitLog.WaitForOffset(ctx, req.Topic, req.Partition, req.MinOffset)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// retention already removed the offset, so we're past it
+			err = nil
+		}
+		return nil, ctx, err
+	default:
+		return nil, ctx, status.Errorf(codes.InvalidArgument,
+			"unknown consistency: %d", req.Consistency)
+	}
+}
+
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (
+	*api.ConsumeBatchResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	maxRecords, maxBytes := req.MaxRecords, req.MaxBytes
+	if maxRecords == 0 {
+		maxRecords = defaultConsumeBatchRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultConsumeBatchBytes
+	}
+	records, err := s.CommitLog.ReadRange(req.Topic, req.Partition, req.Offset, maxRecords, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeBatchResponse{Records: records}, nil
+}
+
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *api.OffsetForTimeRequest) (
+	*api.OffsetForTimeResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	offset, err := s.CommitLog.OffsetForTime(req.Topic, req.Partition, req.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &api.OffsetForTimeResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (
+	*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.CommitLog.CreateTopic(req.Name); err != nil {
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (
+	*api.DeleteTopicResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+		return nil, err
+	}
+	if err := s.CommitLog.DeleteTopic(req.Name); err != nil {
+		return nil, err
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (
+	*api.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	topics, err := s.CommitLog.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListTopicsResponse{
+		Topics:     topics,
+		Partitions: s.CommitLog.PartitionCount(),
+	}, nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (
+	*api.CommitOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+	// offsets are committed through the partition's group, like writes
+	leader, ctx, err := s.leader(ctx, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.CommitOffset(ctx, req)
+	}
+	err = s.CommitLog.CommitOffset(req.Group, req.Topic, req.Partition, req.Offset)
+	if leader, ctx := s.redirect(ctx, req.Partition, err); leader != nil {
+		return leader.CommitOffset(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (
+	*api.FetchOffsetResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+	offset, committed, err := s.CommitLog.FetchOffset(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: offset, Committed: committed}, nil
+}
+
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (
+	*api.JoinGroupResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+	leader, ctx, err := s.leader(ctx, coordinatorPartition)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.JoinGroup(ctx, req)
+	}
+	return s.coordinator.Join(req)
+}
+
+func (s *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (
+	*api.HeartbeatResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	leader, ctx, err := s.leader(ctx, coordinatorPartition)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.Heartbeat(ctx, req)
+	}
+	return s.coordinator.Heartbeat(req)
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (
+	*api.LeaveGroupResponse, error) {
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+	leader, ctx, err := s.leader(ctx, coordinatorPartition)
+	if err != nil {
+		return nil, err
+	}
+	if leader != nil {
+		return leader.LeaveGroup(ctx, req)
+	}
+	if err := s.coordinator.Leave(req); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
 func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (
 	*api.GetServersResponse, error) {
 	servers, err := s.ServersFetcher.GetServers()
@@ -128,19 +407,80 @@ func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest)
 ProduceStream implements a bidirectional streaming
 RPC so the client can stream data into the server’s log and the server can tell
 the client whether each request succeeded.
+
+Requests are received in the background, and whatever requests for the same
+partition of a topic are waiting by the time we get to them are appended as one batch, so a
+client that streams records faster than they can be appended one by one gets
+them batched for free. Responses are still sent for every request, in order.
+On a server that doesn't lead the partition, each batch is forwarded to the
+leader as a ProduceBatch request.
 */
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	reqs := make(chan *api.ProduceRequest, maxProduceStreamBatch)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				recvErr <- stream.Context().Err()
+				return
+			}
+		}
+	}()
+	// next is a request that was received while batching but belongs to another
+	// partition, or has no record, so it starts the next batch; the requests
+	// before one without a record still get their responses
+	var next *api.ProduceRequest
 	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+		req := next
+		next = nil
+		if req == nil {
+			var ok bool
+			if req, ok = <-reqs; !ok {
+				return <-recvErr
+			}
+		}
+		if req.Record == nil {
+			return status.Error(codes.InvalidArgument, "record is required")
+		}
+		records := []*api.Record{req.Record}
+	batch:
+		for len(records) < maxProduceStreamBatch {
+			select {
+			case r, ok := <-reqs:
+				if !ok {
+					break batch
+				}
+				if r.Topic != req.Topic || r.Partition != req.Partition || r.Record == nil {
+					next = r
+					break batch
+				}
+				records = append(records, r.Record)
+			default:
+				break batch
+			}
 		}
-		res, err := s.Produce(stream.Context(), req)
+		res, err := s.ProduceBatch(stream.Context(), &api.ProduceBatchRequest{
+			Records:   records,
+			Topic:     req.Topic,
+			Partition: req.Partition,
+		})
 		if err != nil {
 			return err
 		}
-		if err = stream.Send(res); err != nil {
-			return err
+		for i := range records {
+			if err = stream.Send(&api.ProduceResponse{
+				Offset: res.FirstOffset + uint64(i),
+			}); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -151,41 +491,112 @@ client can tell the server where in the log to read records, and then the server
 will stream every record that follows—even records that aren’t in the log yet!
 When the server reaches the end of the log, the server will wait until someone
 appends a record to the log and then continue streaming records to the client.
+
+A consumer that names its consumer group starts from the offset the group last
+committed instead, so it picks up where the group left off.
 */
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	// the caller is authorized before its stream can be forwarded to the leader
+	if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return err
+	}
+	if req.Group != "" {
+		offset, err := s.FetchOffset(ctx, &api.FetchOffsetRequest{
+			Group:     req.Group,
+			Topic:     req.Topic,
+			Partition: req.Partition,
+		})
+		if err != nil {
+			return err
+		}
+		if offset.Committed {
+			req.Offset = offset.Offset
+		}
+	}
+	leader, leaderCtx, err := s.consistent(ctx, req)
+	if err != nil {
+		return err
+	}
+	if leader != nil {
+		return forwardConsumeStream(leaderCtx, leader, req, stream)
+	}
+	// the stream only has to start from a consistent log: the records that
+	// follow are sent as they're appended
+	req.Consistency = api.Consistency_LOCAL
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
+		res, err := s.Consume(ctx, req)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// block until the record is appended rather than polling for it
+			err = s.CommitLog.WaitForOffset(ctx, req.Topic, req.Partition, req.Offset)
+			if ctx.Err() != nil {
+				// the client went away
+				return nil
 			}
-			if err = stream.Send(res); err != nil {
+			if err != nil {
 				return err
 			}
-			req.Offset++
+			continue
+		default:
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		// the log may skip offsets removed by compaction
+		req.Offset = res.Record.Offset + 1
+	}
+}
+
+// forwardConsumeStream relays the leader's stream of the records the request
+// asks for.
+func forwardConsumeStream(ctx context.Context, leader api.LogClient,
+	req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	leaderStream, err := leader.ConsumeStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := leaderStream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
 		}
 	}
 }
 
-// Authenticate is an interceptor/ middleware that reads the subject out of the client’s
-// cert and writes it to the RPC’s context
-func authenticate(ctx context.Context) (context.Context, error) {
+/*
+Authenticate is an interceptor/ middleware that reads the subject out of the client’s
+cert and writes it to the RPC’s context.
+
+A request another server forwarded carries the subject of the caller it was
+forwarded for, and is authorized as that caller, so forwarding doesn't give
+callers the forwarding server's rights. Only subjects allowed the forward
+action can forward requests, or any caller could claim to be another.
+*/
+func (c *Config) authenticate(ctx context.Context) (context.Context, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
 		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
 	}
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	subject := ""
+	if peer.AuthInfo != nil {
+		tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
+		subject = tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	}
+	if caller, ok := forwardedFor(ctx); ok {
+		if err := c.Authorizer.Authorize(subject, objectWildcard, forwardAction); err != nil {
+			return ctx, err
+		}
+		subject = caller
 	}
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
 	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
 	return ctx, nil
 }
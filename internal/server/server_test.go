@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"flag"
+	"fmt"
 	api "github.com/anshulsood11/loghouse/api/v1"
 	"github.com/anshulsood11/loghouse/internal/auth"
 	"github.com/anshulsood11/loghouse/internal/log"
@@ -50,7 +51,16 @@ func TestServer(t *testing.T) {
 	){
 		"produce/consume a message to/from the log succeeeds": testProduceConsume,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
+		"produce batch succeeds":                              testProduceBatch,
+		"consume batch succeeds":                              testConsumeBatch,
+		"consume stream waits for new records":                testConsumeStreamWaits,
 		"consume past log boundary fails":                     testConsumePastBoundary,
+		"offset for time":                                     testOffsetForTime,
+		"produce/consume by topic":                            testTopics,
+		"produce/consume by partition":                        testPartitions,
+		"commit and fetch offsets":                            testCommitOffset,
+		"consumer groups share partitions":                    testConsumerGroups,
+		"consume with consistency modes":                      testConsistency,
 		"unauthorized fails":                                  testUnauthorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
@@ -91,7 +101,9 @@ func setupTest(t *testing.T) (
 	serverCreds := credentials.NewTLS(serverTLSConfig)
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
-	clog, err := log.NewLog(dir, log.Config{})
+	c := log.Config{}
+	c.Partitions = 2
+	clog, err := log.NewPartitions(dir, c)
 	require.NoError(t, err)
 
 	authorizer := auth.NewAuthorizer(test_util.ACLModelFile, test_util.ACLPolicyFile)
@@ -198,6 +210,27 @@ func testConsumePastBoundary(t *testing.T, client, _ api.LogClient, config *Conf
 	}
 }
 
+func testOffsetForTime(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	start := time.Now()
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:     []byte("hello world"),
+				Timestamp: start.Add(time.Duration(i) * time.Minute).UnixNano(),
+			},
+		})
+		require.NoError(t, err)
+		offsets = append(offsets, produce.Offset)
+	}
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{
+		Timestamp: start.Add(30 * time.Second).UnixNano(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, offsets[1], res.Offset)
+}
+
 func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Config) {
 	ctx := context.Background()
 	records := []*api.Record{{
@@ -235,12 +268,146 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.Timestamp)
+		}
+	}
+}
+
+func testProduceBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.FirstOffset)
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: produce.FirstOffset + uint64(i),
+		})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	// messages without records are valid protobuf, but there's nothing to
+	// append. The client sends nil batch entries as empty records, so they're
+	// passed to the server directly.
+	srv := &grpcServer{Config: config}
+	_, err = srv.ProduceBatch(context.WithValue(ctx, subjectContextKey{}, "root"),
+		&api.ProduceBatchRequest{Records: []*api.Record{{Value: []byte("fourth message")}, nil}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	badStream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, badStream.Send(&api.ProduceRequest{}))
+	_, err = badStream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// requests sent without waiting for their responses may be appended
+	// together, but each one still gets its own response in order
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	const n = 100
+	for i := 0; i < n; i++ {
+		err = stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("message %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(records)+i), res.Offset)
+	}
+	require.NoError(t, stream.CloseSend())
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: uint64(len(records) + n - 1),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte(fmt.Sprintf("message %d", n-1)), consume.Record.Value)
+}
+
+func testConsumeBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+
+	consume, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, len(records))
+	for i, record := range consume.Records {
+		require.Equal(t, records[i].Value, record.Value)
+		require.Equal(t, uint64(i), record.Offset)
+	}
+
+	consume, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset:     1,
+		MaxRecords: 1,
+	})
+	require.NoError(t, err)
+	require.Len(t, consume.Records, 1)
+	require.Equal(t, records[1].Value, consume.Records[0].Value)
+
+	_, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset: uint64(len(records)),
+	})
+	got := grpc.Code(err)
+	want := grpc.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+}
+
+func testConsumeStreamWaits(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	// the stream waits at the end of the log until records are produced
+	received := make(chan *api.Record)
+	go func() {
+		defer close(received)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			received <- res.Record
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		value := []byte(fmt.Sprintf("message %d", i))
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: value},
+		})
+		require.NoError(t, err)
+		select {
+		case record := <-received:
+			require.Equal(t, value, record.Value)
+			require.Equal(t, uint64(i), record.Offset)
+		case <-time.After(time.Second):
+			t.Fatalf("didn't receive record %d", i)
 		}
 	}
+	cancel()
+	for range received {
+	}
 }
 
 func testUnauthorized(t *testing.T, _, unauthorizedClient api.LogClient, config *Config) {
@@ -268,4 +435,228 @@ func testUnauthorized(t *testing.T, _, unauthorizedClient api.LogClient, config
 	if gotCode != wantCode {
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
+
+	createTopic, err := unauthorizedClient.CreateTopic(ctx, &api.CreateTopicRequest{
+		Name: "orders",
+	})
+	if createTopic != nil {
+		t.Fatalf("create topic response should be nil")
+	}
+	gotCode, wantCode = status.Code(err), codes.PermissionDenied
+	if gotCode != wantCode {
+		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
+	}
+}
+
+func testTopics(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("order")},
+		Topic:  "orders",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "../orders"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, list.Topics)
+
+	// each topic has its own offsets
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("default")},
+	})
+	require.NoError(t, err)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("order")},
+		Topic:  "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+		Topic:  "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), consume.Record.Value)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	list, err = client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, list.Topics)
+}
+
+func testPartitions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), list.Partitions)
+
+	for p := uint32(0); p < list.Partitions; p++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:    &api.Record{Value: []byte(fmt.Sprintf("partition %d", p))},
+			Partition: p,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), produce.Offset)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("partition 1"), consume.Record.Value)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("lost")},
+		Partition: list.Partitions,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testCommitOffset(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.False(t, fetch.Committed)
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Offset: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "billing",
+		Topic: "missing",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group:  "billing",
+		Offset: 2,
+	})
+	require.NoError(t, err)
+	fetch, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing"})
+	require.NoError(t, err)
+	require.True(t, fetch.Committed)
+	require.Equal(t, uint64(2), fetch.Offset)
+
+	// a group's stream picks up where the group left off
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "billing"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), res.Record.Value)
+	// a group that hasn't committed starts from the request's offset
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Group:  "shipping",
+		Offset: 1,
+	})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), res.Record.Value)
+}
+
+func testConsumerGroups(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Topics: []string{"orders"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	join := &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}}
+	first, err := client.JoinGroup(ctx, join)
+	require.NoError(t, err)
+	require.Equal(t, "orders", first.Assignments[0].Topic)
+	require.Equal(t, []uint32{0, 1}, first.Assignments[0].Partitions)
+	second, err := client.JoinGroup(ctx, join)
+	require.NoError(t, err)
+	require.Len(t, second.Assignments[0].Partitions, 1)
+
+	// the first member learns of the new generation through its heartbeat
+	heartbeat, err := client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, second.Generation, heartbeat.Generation)
+	require.Len(t, heartbeat.Assignments[0].Partitions, 1)
+	require.NotEqual(t, second.Assignments[0].Partitions,
+		heartbeat.Assignments[0].Partitions)
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.NoError(t, err)
+	heartbeat, err = client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: first.MemberId,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1}, heartbeat.Assignments[0].Partitions)
+	_, err = client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testConsistency(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("first")},
+	})
+	require.NoError(t, err)
+	for _, consistency := range []api.Consistency{
+		api.Consistency_LOCAL,
+		api.Consistency_LEADER_VERIFIED,
+		api.Consistency_AT_LEAST,
+	} {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset:      produce.Offset,
+			Consistency: consistency,
+			MinOffset:   produce.Offset,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), consume.Record.Value)
+	}
+
+	// AT_LEAST reads wait for the server to have the offset
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("second")},
+		})
+	}()
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:      produce.Offset,
+		Consistency: api.Consistency_AT_LEAST,
+		MinOffset:   produce.Offset + 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), consume.Record.Value)
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset + 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), consume.Record.Value)
+
+	// until the client gives up
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Consume(waitCtx, &api.ConsumeRequest{
+		Consistency: api.Consistency_AT_LEAST,
+		MinOffset:   produce.Offset + 2,
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Consistency: 42})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
 }
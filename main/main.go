@@ -1,6 +0,0 @@
-package main
-
-func main() {
-	//srv := server.NewHTTPServer(":8080")
-	//log.Fatal(srv.ListenAndServe())
-}